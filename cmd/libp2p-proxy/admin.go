@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/p2pdao/libp2p-proxy/config"
+	"github.com/p2pdao/libp2p-proxy/protocol"
+)
+
+// serveAdmin serves the admin API in background:
+//
+//	POST /reload re-reads the config file, it responds the ReloadResult.
+//	GET /status responds the ListenerStatus of the proxy listeners.
+func serveAdmin(cfg config.AdminConfig, r *reloader) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+		writeJSON(w, http.StatusOK, r.Status())
+	})
+	mux.HandleFunc("/reload", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+
+		res, err := r.Reload()
+		if err != nil {
+			protocol.Log.Errorf("reload config error: %v", err)
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		fmt.Printf("Config reloaded by admin API, %s\n", res)
+		writeJSON(w, http.StatusOK, res)
+	})
+
+	s := &http.Server{
+		Addr:              cfg.Addr,
+		Handler:           adminAuth(cfg.Token, mux),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := s.ListenAndServe(); err != nil {
+			protocol.Log.Fatal(err)
+		}
+	}()
+}
+
+// ListenerStatus is the connection state of a proxy listener.
+type ListenerStatus struct {
+	Addr        string               `json:"addr"`
+	Standalone  bool                 `json:"standalone"`
+	Connected   bool                 `json:"connected"` // a server peer is healthy, always true in standalone mode
+	Strategy    string               `json:"strategy,omitempty"`
+	ServerPeers []protocol.PeerState `json:"server_peers,omitempty"`
+}
+
+// Status returns the states of the proxy listeners in the config order.
+func (r *reloader) Status() []ListenerStatus {
+	status := []ListenerStatus{}
+	for _, pc := range r.cfg.ProxyListeners() {
+		l := r.listeners[pc.Addr]
+		if l == nil {
+			continue
+		}
+		ls := ListenerStatus{Addr: l.Addr(), Standalone: true, Connected: true}
+		if g := l.Group(); g != nil {
+			ls.Standalone = false
+			ls.Connected = g.Connected()
+			ls.Strategy = g.Strategy()
+			ls.ServerPeers = g.States()
+		}
+		status = append(status, ls)
+	}
+	return status
+}
+
+func adminAuth(token string, h http.Handler) http.Handler {
+	if token == "" {
+		return h
+	}
+
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), expected) != 1 {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
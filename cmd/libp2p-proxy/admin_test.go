@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminAuth(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		token, header string
+		want          int
+	}{
+		{"", "", http.StatusOK},
+		{"", "Bearer anything", http.StatusOK},
+		{"secret", "", http.StatusUnauthorized},
+		{"secret", "Bearer secret", http.StatusOK},
+		{"secret", "Bearer secret2", http.StatusUnauthorized},
+		{"secret", "Bearer secre", http.StatusUnauthorized},
+		{"secret", "bearer secret", http.StatusUnauthorized},
+		{"secret", "secret", http.StatusUnauthorized},
+		{"secret", "Basic c2VjcmV0", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/status", nil)
+		if tt.header != "" {
+			req.Header.Set("Authorization", tt.header)
+		}
+		w := httptest.NewRecorder()
+		adminAuth(tt.token, ok).ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Errorf("token %q, Authorization %q: status = %d, want %d", tt.token, tt.header, w.Code, tt.want)
+		}
+	}
+}
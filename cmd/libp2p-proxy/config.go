@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/p2pdao/libp2p-proxy/config"
+)
+
+const configUsage = `Usage:
+    libp2p-proxy config check [-config path] [-key value ...]
+    libp2p-proxy config print [-config path] [-key value ...]
+    libp2p-proxy config schema
+
+Commands:
+    check    validate the effective config, and report every problem
+    print    print the effective config in YAML, the secrets are redacted
+    schema   print the JSON Schema of the config files for the editor validation
+
+The effective config is merged from the defaults, the config file,
+the LIBP2P_PROXY_* environment variables and the flags.
+
+Command flags:
+`
+
+// configCommand runs the "config" sub commands, it exits the process.
+func configCommand(args []string) {
+	fs := flag.NewFlagSet("config", flag.ExitOnError)
+	cfgPath := fs.String("config", os.Getenv(config.EnvPrefix+"CONFIG"), "json, yaml or toml configuration file, env LIBP2P_PROXY_CONFIG; empty uses the default configuration")
+	cfgFlags := config.RegisterFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), configUsage)
+		fs.PrintDefaults()
+	}
+
+	if len(args) == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	cmd := args[0]
+	if cmd != "check" && cmd != "print" && cmd != "schema" {
+		fmt.Fprintf(fs.Output(), "unknown config command: %s\n", cmd)
+		fs.Usage()
+		os.Exit(2)
+	}
+	fs.Parse(args[1:])
+
+	if cmd == "schema" {
+		data, err := json.MarshalIndent(config.JSONSchema(), "", "  ")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println(string(data))
+		os.Exit(0)
+	}
+
+	cfg, err := config.Load(*cfgPath, cfgFlags)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	switch cmd {
+	case "check":
+		for _, w := range cfg.Warnings() {
+			fmt.Fprintf(os.Stderr, "warning: %s\n", w)
+		}
+		if err := cfg.Validate(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println("config ok")
+
+	case "print":
+		data, err := yaml.Marshal(cfg.Redacted())
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Stdout.Write(data)
+	}
+	os.Exit(0)
+}
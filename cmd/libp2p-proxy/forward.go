@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+
+	"github.com/p2pdao/libp2p-proxy/config"
+	"github.com/p2pdao/libp2p-proxy/protocol"
+)
+
+// serveForwards exposes the forward targets and serves the forward listeners
+// in background, a listener without peer tunnels to defaultPeer.
+func serveForwards(proxy *protocol.ProxyService, h host.Host, forwards []config.ForwardConfig, defaultPeer peer.ID) {
+	for _, fw := range forwards {
+		var id peer.ID
+		if fw.Peer != "" {
+			var err error
+			if id, err = forwardPeer(h, fw.Peer); err != nil {
+				protocol.Log.Fatalf("forward %s: %v", fw.Name, err)
+			}
+		}
+
+		switch {
+		case fw.Listen != "" && fw.Target != "":
+			protocol.Log.Fatalf("forward %s: listen and target can't be used together", fw.Name)
+
+		case fw.Target != "":
+			if err := proxy.AddForwardTarget(fw.Name, fw.Target, id); err != nil {
+				protocol.Log.Fatal(err)
+			}
+			fmt.Printf("Forward %s target: %s\n", fw.Name, fw.Target)
+
+		case fw.Listen != "":
+			if id == "" {
+				id = defaultPeer
+			}
+			if id == "" || id == h.ID() {
+				protocol.Log.Fatalf("forward %s: peer is required", fw.Name)
+			}
+
+			fmt.Printf("Forward %s listen: %s -> %s\n", fw.Name, fw.Listen, id)
+			name, addr := fw.Name, fw.Listen
+			go func() {
+				if err := proxy.ServeForward(name, addr, id); err != nil && err != context.Canceled {
+					protocol.Log.Fatal(err)
+				}
+			}()
+
+		default:
+			protocol.Log.Fatalf("forward %s: listen or target is required", fw.Name)
+		}
+	}
+}
+
+// forwardPeer parses a peer ID or a full multiaddr, the addresses are
+// added to the peerstore.
+func forwardPeer(h host.Host, s string) (peer.ID, error) {
+	pi, err := parsePeer(s)
+	if err != nil {
+		return "", err
+	}
+	h.Peerstore().AddAddrs(pi.ID, pi.Addrs, peerstore.PermanentAddrTTL)
+	return pi.ID, nil
+}
@@ -9,6 +9,7 @@ import (
 	"os/signal"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -20,6 +21,8 @@ import (
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/core/routing"
+	drouting "github.com/libp2p/go-libp2p/p2p/discovery/routing"
+	"github.com/libp2p/go-libp2p/p2p/host/autorelay"
 	"github.com/libp2p/go-libp2p/p2p/protocol/ping"
 	ma "github.com/multiformats/go-multiaddr"
 
@@ -42,22 +45,34 @@ or:
     export http_proxy=socks5://127.0.0.1:1082 https_proxy=socks5://127.0.0.1:1082
 then:
     curl "https://github.com"
+
+Every config key can be set by the environment variable or the flag of it, such as:
+    LIBP2P_PROXY_PEER_KEY_FILE=/run/secrets/peer_key ./libp2p-proxy -config server.json -acl.allow_peers 12D3KooW...
+the flags take precedence over the environment variables, and they over the config file.
+Check or print the effective config with:
+    ./libp2p-proxy config check -config server.json
+    ./libp2p-proxy config print -config server.json
 -------------------------------------------------------
 Command flags:
 `
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		configCommand(os.Args[2:])
+	}
+
 	// Parse some flags
-	cfgPath := flag.String("config", "", "json configuration file; empty uses the default configuration")
-	peerID := flag.String("peer", "", "proxy server peer address")
+	cfgPath := flag.String("config", os.Getenv(config.EnvPrefix+"CONFIG"), "json, yaml or toml configuration file, env LIBP2P_PROXY_CONFIG; empty uses the default configuration")
+	peerID := flag.String("peer", "", "proxy server peer address or peer ID")
 	proxyAddr := flag.String("addr", "", "proxy client address, default is 127.0.0.1:1082")
 	help := flag.Bool("help", false, "show help info")
 	genKey := flag.Bool("key", false, "generate a new peer private key")
 	// version := flag.Bool("version", false, "show version info")
+	cfgFlags := config.RegisterFlags(flag.CommandLine)
 	flag.Parse()
 
 	if *help {
-		fmt.Println(usage)
+		fmt.Print(usage)
 		flag.PrintDefaults()
 		os.Exit(0)
 	}
@@ -72,33 +87,42 @@ func main() {
 		os.Exit(0)
 	}
 
-	flag.Parse()
-	cfg, err := config.LoadConfig(*cfgPath)
+	cfg, err := config.Load(*cfgPath, cfgFlags)
 	if err != nil {
 		protocol.Log.Fatal(err)
 	}
 
-	if peerID != nil && *peerID != "" {
-		if cfg.Proxy == nil {
-			cfg.Proxy = &config.ProxyConfig{}
-		}
-		cfg.Proxy.ServerPeer = *peerID
-		if cfg.Proxy.Addr == "" {
-			cfg.Proxy.Addr = "127.0.0.1:1082"
+	// overrides applies the command flags and defaults, it is also used on reload.
+	overrides := func(cfg *config.Config) {
+		if peerID != nil && *peerID != "" {
+			if cfg.Proxy == nil {
+				cfg.Proxy = &config.ProxyConfig{}
+			}
+			cfg.Proxy.ServerPeer = *peerID
+			if cfg.Proxy.Addr == "" {
+				cfg.Proxy.Addr = "127.0.0.1:1082"
+			}
+			if proxyAddr != nil && *proxyAddr != "" {
+				cfg.Proxy.Addr = *proxyAddr
+			}
 		}
-		if proxyAddr != nil && *proxyAddr != "" {
-			cfg.Proxy.Addr = *proxyAddr
+
+		if cfg.P2PHost == "" {
+			cfg.P2PHost = "p2p.to"
 		}
 	}
+	overrides(&cfg)
+	if err := cfg.Validate(); err != nil {
+		protocol.Log.Fatal(err)
+	}
+	for _, w := range cfg.Warnings() {
+		protocol.Log.Warn(w)
+	}
 
 	if cfg.PeerKey == "" {
 		cfg.PeerKey, _, _ = GeneratePeerKey()
 	}
 
-	if cfg.P2PHost == "" {
-		cfg.P2PHost = "p2p.to"
-	}
-
 	ctx := ContextWithSignal(context.Background())
 	privk, err := ReadPeerKey(cfg.PeerKey)
 	if err != nil {
@@ -113,29 +137,20 @@ func main() {
 		libp2p.WithDialTimeout(time.Second * 60),
 	}
 
-	// if len(cfg.Network.Relays) > 0 {
-	// 	relays := make([]peer.AddrInfo, 0, len(cfg.Network.Relays))
-	// 	for _, addr := range cfg.Network.Relays {
-	// 		pi, err := peer.AddrInfoFromString(addr)
-	// 		if err != nil {
-	// 			protocol.Log.Fatal(fmt.Sprintf("failed to initialize default static relays: %s", err))
-	// 		}
-	// 		relays = append(relays, *pi)
-	// 	}
-	// 	opts = append(opts,
-	// 		libp2p.EnableAutoRelay(),
-	// 		libp2p.StaticRelays(relays),
-	// 	)
-	// }
-
 	acl, err := protocol.NewACL(cfg.ACL)
 	if err != nil {
 		protocol.Log.Fatal(err)
 	}
 	opts = append(opts, libp2p.ConnectionGater(acl))
 
-	if cfg.Proxy == nil || cfg.Proxy.ServerPeer == "" {
-		// run DHT client for server side
+	egress, err := protocol.NewEgressPolicy(cfg.Egress)
+	if err != nil {
+		protocol.Log.Fatal(err)
+	}
+	// the DHT for the AutoRelay candidates, the discovery and the server peer routing
+	// the DHT of the relay candidates of AutoRelay, the discovery and the peer routing of the server peers
+	var kdht atomic.Pointer[dht.IpfsDHT]
+	if runDHT(&cfg) {
 		var ds datastore.Batching
 		if cfg.DHT.DatastorePath != "" {
 			ds, err = leveldb.NewDatastore(cfg.DHT.DatastorePath, nil)
@@ -173,17 +188,32 @@ func main() {
 				idht, err := dht.New(ctx, h, dhtopts...)
 				if err == nil {
 					idht.Bootstrap(ctx)
+					kdht.Store(idht)
 				}
 				return idht, err
 			}),
 		)
 	}
 
-	if cfg.Proxy == nil {
+	if !cfg.ClientSide() {
 		opts = append(opts,
 			libp2p.ListenAddrStrings(cfg.Network.ListenAddrs...),
 		)
 
+		relays, err := parseRelays(cfg.Network.Relays)
+		if err != nil {
+			protocol.Log.Fatal(err)
+		}
+		if len(relays) > 0 {
+			opts = append(opts, libp2p.EnableAutoRelay(autorelay.WithStaticRelays(relays)))
+		} else {
+			opts = append(opts, libp2p.EnableAutoRelay(dhtRelaySource(&kdht)))
+		}
+
+		if cfg.RelayService.Enable {
+			opts = append(opts, libp2p.EnableRelayService(relayServiceOptions(cfg.RelayService, acl)...))
+		}
+
 		if cfg.Network.EnableNAT {
 			opts = append(opts,
 				libp2p.NATPortMap(),
@@ -219,14 +249,42 @@ func main() {
 		for _, addr := range host.Addrs() {
 			fmt.Printf("\t%s/p2p/%s\n", addr, host.ID())
 		}
+		if err := printRelayAddrs(ctx, host); err != nil {
+			protocol.Log.Fatal(err)
+		}
 
 		ping.NewPingService(host)
-		proxy := protocol.NewProxyService(ctx, host, cfg.P2PHost)
+		if cfg.Discovery.Advertise {
+			go protocol.Advertise(ctx, drouting.NewRoutingDiscovery(kdht.Load()), cfg.Discovery.Network)
+			fmt.Printf("Advertise: %s\n", protocol.DiscoveryNamespace(cfg.Discovery.Network))
+		}
+		if cfg.Discovery.MDNS {
+			if _, err := protocol.AdvertiseMDNS(host); err != nil {
+				protocol.Log.Fatal(err)
+			}
+			fmt.Printf("Advertise: mDNS %s\n", protocol.MDNSServiceName)
+		}
+		proxy := protocol.NewProxyService(ctx, host, cfg.P2PHost, proxyOptions(&cfg, acl, egress)...)
+		serveReload(ctx, &reloader{path: *cfgPath, flags: cfgFlags, overrides: overrides, cfg: cfg, acl: acl, proxy: proxy})
+
+		serveForwards(proxy, host, cfg.Forwards, "")
+		serveSites(proxy, cfg.Sites)
+
+		if cfg.ServePath != "" || cfg.ServeUpstream != "" {
+			handler, s, err := newSite(config.SiteConfig{
+				ServePath:     cfg.ServePath,
+				ServeUpstream: cfg.ServeUpstream,
+			})
+			if err != nil {
+				protocol.Log.Fatal(err)
+			}
 
-		if cfg.ServePath != "" {
-			ss := newStatic(cfg.ServePath)
-			fmt.Printf("Serve HTTP static: %s\n", ss)
-			if err := proxy.ServeHTTP(ss, nil); err != nil {
+			if cfg.ServePath != "" {
+				fmt.Printf("Serve HTTP static: %s\n", handler)
+			} else {
+				fmt.Printf("Serve HTTP upstream: %s\n", cfg.ServeUpstream)
+			}
+			if err := proxy.ServeHTTP(handler, s); err != nil {
 				protocol.Log.Fatal(err)
 			}
 		} else {
@@ -245,39 +303,186 @@ func main() {
 		}
 
 		fmt.Printf("Peer ID: %s\n", host.ID())
-		serverPeer := &peer.AddrInfo{ID: host.ID()}
-		if cfg.Proxy.ServerPeer != "" {
-			serverPeer, err = peer.AddrInfoFromString(cfg.Proxy.ServerPeer)
+		proxy := protocol.NewProxyService(ctx, host, cfg.P2PHost, proxyOptions(&cfg, acl, egress)...)
+		listeners := make(map[string]*protocol.Listener)
+		var defaultPeer peer.ID
+		for i, pc := range cfg.ProxyListeners() {
+			var group *protocol.PeerGroup
+			if !pc.Standalone() {
+				if group, err = newPeerGroup(ctx, host, kdht.Load(), pc, cfg.Discovery); err != nil {
+					protocol.Log.Fatal(err)
+				}
+				if peers := group.Peers(); i == 0 && len(peers) > 0 {
+					defaultPeer = peers[0]
+				}
+			}
+
+			l, err := proxy.NewListener(pc.Addr, group, pc.Protocols)
 			if err != nil {
 				protocol.Log.Fatal(err)
 			}
-
-			// host.Peerstore().AddAddrs(serverPeer.ID, serverPeer.Addrs, peerstore.PermanentAddrTTL)
-			ctxt, cancel := context.WithTimeout(ctx, time.Second*5)
-			if err = host.Connect(ctxt, *serverPeer); err != nil {
+			creds, err := protocol.NewCredentials(pc.Users)
+			if err != nil {
 				protocol.Log.Fatal(err)
 			}
-			res := <-ping.Ping(ctxt, host, serverPeer.ID)
-			if res.Error != nil {
-				protocol.Log.Fatalf("ping error: %v", res.Error)
+			l.SetCredentials(creds)
+			listeners[pc.Addr] = l
+		}
+
+		serveReload(ctx, &reloader{path: *cfgPath, flags: cfgFlags, overrides: overrides, cfg: cfg, acl: acl, proxy: proxy, listeners: listeners})
+		serveForwards(proxy, host, cfg.Forwards, defaultPeer)
+		for _, pc := range cfg.ProxyListeners() {
+			l := listeners[pc.Addr]
+			if g := l.Group(); g == nil {
+				fmt.Printf("Proxy Address: %s (standalone)\n", l.Addr())
 			} else {
-				protocol.Log.Infof("ping RTT: %s", res.RTT)
+				to := peerList(g.Peers())
+				if pc.Discover && cfg.Discovery.Network != "" {
+					to += ", discovery " + protocol.DiscoveryNamespace(cfg.Discovery.Network)
+				}
+				if pc.Discover && cfg.Discovery.MDNS {
+					to += ", mDNS " + protocol.MDNSServiceName
+				}
+				to = strings.TrimPrefix(to, ", ")
+				fmt.Printf("Proxy Address: %s -> %s (%s)\n", l.Addr(), to, g.Strategy())
 			}
-			cancel()
-			host.ConnManager().Protect(serverPeer.ID, "proxy")
+			go func() {
+				if err := l.Serve(); err != nil && err != context.Canceled {
+					protocol.Log.Fatal(err)
+				}
+			}()
 		}
-
-		proxy := protocol.NewProxyService(ctx, host, cfg.P2PHost)
-		fmt.Printf("Proxy Address: %s\n", cfg.Proxy.Addr)
-		if err := proxy.Serve(cfg.Proxy.Addr, serverPeer.ID); err != nil {
+		if err := proxy.Wait(nil); err != nil {
 			protocol.Log.Fatal(err)
 		}
 	}
 }
 
+// proxyOptions returns the options of the proxy service, they are applied
+// before it serves any stream.
+func proxyOptions(cfg *config.Config, acl *protocol.ACLFilter, egress *protocol.EgressPolicy) []protocol.Option {
+	return []protocol.Option{
+		protocol.WithForwardedHeaders(cfg.ForwardedHeaders),
+		protocol.WithEgressPolicy(egress),
+		protocol.WithACL(acl),
+	}
+}
+
+// newPeerGroup returns the server peers of a proxy listener, the unreachable
+// peers are reconnected in background until ctx is done. The DHT re-resolves
+// the peer addresses and discovers more peers, it is nil on the client side
+// without dht.client_side, discovery.network or a peer ID only server peer.
+func newPeerGroup(ctx context.Context, h host.Host, d *dht.IpfsDHT, pc config.ProxyConfig, dc config.DiscoveryConfig) (*protocol.PeerGroup, error) {
+	addrs := pc.ServerPeerAddrs()
+	peers := make([]peer.AddrInfo, 0, len(addrs))
+	for _, addr := range addrs {
+		pi, err := parsePeer(addr)
+		if err != nil {
+			return nil, err
+		}
+		peers = append(peers, pi)
+	}
+
+	var r routing.PeerRouting
+	if d != nil {
+		r = d
+	}
+	group, err := protocol.NewPeerGroup(h, r, peers, pc.Strategy)
+	if err != nil {
+		return nil, err
+	}
+	if len(peers) > 0 && group.Check(ctx) == 0 {
+		if d == nil {
+			protocol.Log.Warnf("no server peer of %s is reachable, redialing the configured addresses in background, set dht.client_side to re-resolve them", pc.Addr)
+		} else {
+			protocol.Log.Warnf("no server peer of %s is reachable, reconnecting in background", pc.Addr)
+		}
+	}
+	go group.Run(ctx, time.Duration(pc.HealthCheckInterval)*time.Second)
+
+	if pc.Discover {
+		allow, err := allowPeers(dc.AllowPeers)
+		if err != nil {
+			return nil, err
+		}
+		if dc.Network != "" {
+			go group.Discover(ctx, drouting.NewRoutingDiscovery(d), dc.Network, allow)
+		}
+		if dc.MDNS {
+			go group.DiscoverMDNS(ctx, allow)
+		}
+	}
+	return group, nil
+}
+
+// allowPeers returns the filter of the peer IDs, nil for an empty list that allows all.
+func allowPeers(ids []string) (func(peer.ID) bool, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	allowed := make(map[peer.ID]bool, len(ids))
+	for _, s := range ids {
+		id, err := peer.Decode(s)
+		if err != nil {
+			return nil, err
+		}
+		allowed[id] = true
+	}
+	return func(id peer.ID) bool { return allowed[id] }, nil
+}
+
+// peerList formats the peer IDs as "a, b".
+func peerList(ids []peer.ID) string {
+	ss := make([]string, len(ids))
+	for i, id := range ids {
+		ss[i] = id.String()
+	}
+	return strings.Join(ss, ", ")
+}
+
+// parsePeer parses a peer ID or a full multiaddr, a peer ID has no addresses
+// and is found by the DHT.
+func parsePeer(s string) (peer.AddrInfo, error) {
+	if !strings.HasPrefix(s, "/") {
+		id, err := peer.Decode(s)
+		return peer.AddrInfo{ID: id}, err
+	}
+
+	pi, err := peer.AddrInfoFromString(s)
+	if err != nil {
+		return peer.AddrInfo{}, err
+	}
+	return *pi, nil
+}
+
+// runDHT reports whether the peer runs the DHT client: on the server side, in
+// standalone mode, for discovery, and for the peers given by peer ID only.
+func runDHT(cfg *config.Config) bool {
+	if !cfg.ClientSide() || cfg.DHT.ClientSide || cfg.Discovery.Network != "" {
+		return true
+	}
+	for _, pc := range cfg.ProxyListeners() {
+		if pc.Standalone() {
+			return true
+		}
+		for _, s := range pc.ServerPeerAddrs() {
+			if !strings.HasPrefix(s, "/") {
+				return true
+			}
+		}
+	}
+	for _, fw := range cfg.Forwards {
+		if fw.Peer != "" && !strings.HasPrefix(fw.Peer, "/") {
+			return true
+		}
+	}
+	return false
+}
+
 func ContextWithSignal(ctx context.Context) context.Context {
 	newCtx, cancel := context.WithCancel(ctx)
-	signals := make(chan os.Signal)
+	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-signals
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/host/autorelay"
+	relayv2 "github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
+	ma "github.com/multiformats/go-multiaddr"
+
+	"github.com/p2pdao/libp2p-proxy/config"
+	"github.com/p2pdao/libp2p-proxy/protocol"
+)
+
+// parseRelays parses the relay multiaddrs, every relay must have the /p2p/ peer ID,
+// the addresses of the same relay are merged.
+func parseRelays(addrs []string) ([]peer.AddrInfo, error) {
+	mas := make([]ma.Multiaddr, 0, len(addrs))
+	for _, s := range addrs {
+		addr, err := ma.NewMultiaddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid relay %q: %v", s, err)
+		}
+		if _, err := addr.ValueForProtocol(ma.P_CIRCUIT); err == nil {
+			return nil, fmt.Errorf("invalid relay %q: relay address can't be a circuit address", s)
+		}
+		if _, err := addr.ValueForProtocol(ma.P_P2P); err != nil {
+			return nil, fmt.Errorf("invalid relay %q: no \"/p2p/\" peer ID", s)
+		}
+		mas = append(mas, addr)
+	}
+	return peer.AddrInfosFromP2pAddrs(mas...)
+}
+
+// relayServiceOptions returns the circuit v2 relay options with the configured limits,
+// the relay is restricted by acl if UseACL is set.
+func relayServiceOptions(cfg config.RelayServiceConfig, acl *protocol.ACLFilter) []relayv2.Option {
+	rc := relayv2.DefaultResources()
+	setTimeout(&rc.ReservationTTL, cfg.ReservationTTL)
+	setLimit(&rc.MaxReservations, cfg.MaxReservations)
+	setLimit(&rc.MaxReservationsPerPeer, cfg.MaxReservationsPerPeer)
+	setLimit(&rc.MaxReservationsPerIP, cfg.MaxReservationsPerIP)
+	setLimit(&rc.MaxReservationsPerASN, cfg.MaxReservationsPerASN)
+	setLimit(&rc.MaxCircuits, cfg.MaxCircuits)
+	setLimit(&rc.BufferSize, cfg.BufferSize)
+	setTimeout(&rc.Limit.Duration, cfg.CircuitDuration)
+	if cfg.CircuitData > 0 {
+		rc.Limit.Data = cfg.CircuitData
+	}
+
+	opts := []relayv2.Option{relayv2.WithResources(rc)}
+	if cfg.UseACL {
+		opts = append(opts, relayv2.WithACL(acl))
+	}
+	return opts
+}
+
+func setLimit(v *int, n int) {
+	if n > 0 {
+		*v = n
+	}
+}
+
+// dhtRelaySource returns the AutoRelay peer source with the peers of the DHT routing table,
+// it sends nothing before the DHT is running.
+func dhtRelaySource(d *atomic.Pointer[dht.IpfsDHT]) autorelay.Option {
+	return autorelay.WithPeerSource(func(ctx context.Context, numPeers int) <-chan peer.AddrInfo {
+		ch := make(chan peer.AddrInfo, numPeers)
+		defer close(ch)
+
+		idht := d.Load()
+		if idht == nil {
+			return ch
+		}
+		for _, id := range idht.RoutingTable().ListPeers() {
+			if len(ch) == numPeers {
+				break
+			}
+			if pi := idht.Host().Peerstore().PeerInfo(id); len(pi.Addrs) > 0 {
+				ch <- pi
+			}
+		}
+		return ch
+	}, time.Minute)
+}
+
+// printRelayAddrs prints the /p2p-circuit addresses when the relay reservations are made.
+func printRelayAddrs(ctx context.Context, h host.Host) error {
+	sub, err := h.EventBus().Subscribe(new(event.EvtLocalAddressesUpdated))
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		defer sub.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case e, ok := <-sub.Out():
+				if !ok {
+					return
+				}
+				for _, ua := range e.(event.EvtLocalAddressesUpdated).Current {
+					if ua.Action != event.Added {
+						continue
+					}
+					if _, err := ua.Address.ValueForProtocol(ma.P_CIRCUIT); err == nil {
+						fmt.Printf("Relay Address: %s/p2p/%s\n", ua.Address, h.ID())
+					}
+				}
+			}
+		}
+	}()
+	return nil
+}
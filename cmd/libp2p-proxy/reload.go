@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/p2pdao/libp2p-proxy/config"
+	"github.com/p2pdao/libp2p-proxy/protocol"
+)
+
+// restartFields are the settings applied at startup only.
+var restartFields = []struct {
+	name string
+	get  func(cfg *config.Config) interface{}
+}{
+	{"peer_key", func(cfg *config.Config) interface{} { return cfg.PeerKey }},
+	{"p2p_host", func(cfg *config.Config) interface{} { return cfg.P2PHost }},
+	{"serve_path", func(cfg *config.Config) interface{} { return cfg.ServePath }},
+	{"serve_upstream", func(cfg *config.Config) interface{} { return cfg.ServeUpstream }},
+	{"sites", func(cfg *config.Config) interface{} { return cfg.Sites }},
+	{"forwarded_headers", func(cfg *config.Config) interface{} { return cfg.ForwardedHeaders }},
+	{"forwards", func(cfg *config.Config) interface{} { return cfg.Forwards }},
+	{"network", func(cfg *config.Config) interface{} { return cfg.Network }},
+	{"dht", func(cfg *config.Config) interface{} { return cfg.DHT }},
+	{"discovery", func(cfg *config.Config) interface{} { return cfg.Discovery }},
+	{"relay_service", func(cfg *config.Config) interface{} { return cfg.RelayService }},
+	{"admin", func(cfg *config.Config) interface{} { return cfg.Admin }},
+	{"proxy", func(cfg *config.Config) interface{} { return listenerKeys(cfg.Proxy) }},
+	{"proxies", func(cfg *config.Config) interface{} {
+		keys := make([]interface{}, len(cfg.Proxies))
+		for i := range cfg.Proxies {
+			keys[i] = listenerKeys(&cfg.Proxies[i])
+		}
+		return keys
+	}},
+}
+
+// ReloadResult reports the changed settings of a reload.
+type ReloadResult struct {
+	Reloaded        []string `json:"reloaded"`
+	RestartRequired []string `json:"restart_required"`
+	ClosedConns     int      `json:"closed_connections"`
+}
+
+func (r *ReloadResult) String() string {
+	s := fmt.Sprintf("reloaded: [%s], restart required: [%s]",
+		strings.Join(r.Reloaded, ", "), strings.Join(r.RestartRequired, ", "))
+	if r.ClosedConns > 0 {
+		s += fmt.Sprintf(", closed connections: %d", r.ClosedConns)
+	}
+	return s
+}
+
+// reloader re-loads the config layers and swaps the acl, egress and proxy users
+// of the running proxy, a bad config changes nothing.
+type reloader struct {
+	mu        sync.Mutex
+	path      string
+	flags     *config.Overrides
+	overrides func(cfg *config.Config)
+	cfg       config.Config // the startup config, the other settings are compared with it
+	acl       *protocol.ACLFilter
+	proxy     *protocol.ProxyService
+	listeners map[string]*protocol.Listener // by addr
+}
+
+func (r *reloader) Reload() (*ReloadResult, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cfg, err := config.Load(r.path, r.flags)
+	if err != nil {
+		return nil, err
+	}
+	r.overrides(&cfg)
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	for _, w := range cfg.Warnings() {
+		protocol.Log.Warn(w)
+	}
+	if cfg.PeerKey == "" {
+		// the random key generated at startup
+		cfg.PeerKey = r.cfg.PeerKey
+	}
+
+	egress, err := protocol.NewEgressPolicy(cfg.Egress)
+	if err != nil {
+		return nil, err
+	}
+	creds := make(map[*protocol.Listener]*protocol.Credentials)
+	for _, pc := range cfg.ProxyListeners() {
+		c, err := protocol.NewCredentials(pc.Users)
+		if err != nil {
+			return nil, err
+		}
+		if l, ok := r.listeners[pc.Addr]; ok {
+			creds[l] = c
+		}
+	}
+	if err := r.acl.Update(cfg.ACL); err != nil {
+		return nil, err
+	}
+
+	res := &ReloadResult{Reloaded: []string{"acl", "egress"}, RestartRequired: []string{}}
+	r.proxy.SetEgressPolicy(egress)
+	for l, c := range creds {
+		l.SetCredentials(c)
+	}
+	if len(creds) > 0 {
+		res.Reloaded = append(res.Reloaded, "proxy.users")
+	}
+	if cfg.ACL.CloseDisallowed {
+		res.ClosedConns = r.proxy.CloseDisallowed()
+	}
+
+	for _, f := range restartFields {
+		if !reflect.DeepEqual(f.get(&r.cfg), f.get(&cfg)) {
+			res.RestartRequired = append(res.RestartRequired, f.name)
+		}
+	}
+	return res, nil
+}
+
+// serveReload reloads the config on SIGHUP, and by the admin API if it is enabled.
+func serveReload(ctx context.Context, r *reloader) {
+	r.watchSIGHUP(ctx)
+	if r.cfg.Admin.Addr != "" {
+		fmt.Printf("Admin API: http://%s\n", r.cfg.Admin.Addr)
+		serveAdmin(r.cfg.Admin, r)
+	}
+}
+
+// watchSIGHUP reloads the config on SIGHUP.
+func (r *reloader) watchSIGHUP(ctx context.Context) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(signals)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-signals:
+				res, err := r.Reload()
+				if err != nil {
+					protocol.Log.Errorf("reload config error: %v", err)
+					continue
+				}
+				fmt.Printf("Config reloaded, %s\n", res)
+			}
+		}
+	}()
+}
+
+// listenerKeys returns the proxy listener settings applied at startup, nil for no listener.
+func listenerKeys(pc *config.ProxyConfig) interface{} {
+	if pc == nil {
+		return nil
+	}
+	return [7]interface{}{pc.Addr, pc.ServerPeer, pc.Protocols, pc.ServerPeers, pc.Strategy, pc.HealthCheckInterval, pc.Discover}
+}
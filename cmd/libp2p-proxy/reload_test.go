@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+
+	"github.com/p2pdao/libp2p-proxy/config"
+	"github.com/p2pdao/libp2p-proxy/protocol"
+)
+
+// proxyStatus returns the status of a GET through the proxy with the credential.
+func proxyStatus(t *testing.T, addr, user, password string) int {
+	t.Helper()
+	hc := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			Proxy: http.ProxyURL(&url.URL{Scheme: "http", User: url.UserPassword(user, password), Host: addr}),
+		},
+	}
+	resp, err := hc.Get("http://127.0.0.1:1/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestReload(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn, err := mocknet.FullMeshConnected(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mn.Close()
+	h, remote := mn.Hosts()[0], mn.Hosts()[1]
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	write := func(format string, args ...interface{}) {
+		if err := os.WriteFile(path, []byte(fmt.Sprintf(format, args...)), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`p2p_host: "p2p.to"
+proxy:
+  addr: %q
+  users:
+    - username: alice
+      password: old-password
+`, addr)
+
+	cfg, err := config.Load(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acl, err := protocol.NewACL(cfg.ACL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := protocol.NewProxyService(ctx, h, cfg.P2PHost, protocol.WithACL(acl))
+	l, err := proxy.NewListener(addr, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds, err := protocol.NewCredentials(cfg.Proxy.Users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.SetCredentials(creds)
+	go l.Serve()
+
+	r := &reloader{
+		path:      path,
+		overrides: func(cfg *config.Config) {},
+		cfg:       cfg,
+		acl:       acl,
+		proxy:     proxy,
+		listeners: map[string]*protocol.Listener{addr: l},
+	}
+
+	// the server may not serve yet.
+	for i := 0; i < 50; i++ {
+		if c, err := net.Dial("tcp", addr); err == nil {
+			c.Close()
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if code := proxyStatus(t, addr, "alice", "new-password"); code != http.StatusProxyAuthRequired {
+		t.Fatalf("the new password before the reload: %d", code)
+	}
+
+	// the acl and the users are swapped, p2p_host requires a restart.
+	write(`p2p_host: "p2p.example"
+acl:
+  deny_peers: [%q]
+proxy:
+  addr: %q
+  users:
+    - username: alice
+      password: new-password
+`, remote.ID(), addr)
+	res, err := r.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &ReloadResult{
+		Reloaded:        []string{"acl", "egress", "proxy.users"},
+		RestartRequired: []string{"p2p_host"},
+	}
+	if !reflect.DeepEqual(res, want) {
+		t.Errorf("Reload() = %+v, want %+v", res, want)
+	}
+	if acl.Allow(remote.ID(), nil) {
+		t.Error("the denied peer is allowed after the reload")
+	}
+	if code := proxyStatus(t, addr, "alice", "new-password"); code == http.StatusProxyAuthRequired {
+		t.Error("the new password is not reloaded")
+	}
+	if code := proxyStatus(t, addr, "alice", "old-password"); code != http.StatusProxyAuthRequired {
+		t.Errorf("the old password after the reload: %d", code)
+	}
+	if len(h.Network().ConnsToPeer(remote.ID())) == 0 {
+		t.Error("the connection of the denied peer is closed without close_disallowed")
+	}
+
+	// a bad config changes nothing.
+	write(`acl:
+  deny_peers: ["not a peer"]
+proxy:
+  addr: %q
+  users:
+    - username: alice
+      password: bad-config
+`, addr)
+	if _, err := r.Reload(); err == nil {
+		t.Fatal("Reload() of a bad config is ok")
+	}
+	if acl.Allow(remote.ID(), nil) {
+		t.Error("the acl is changed by a bad config")
+	}
+	if code := proxyStatus(t, addr, "alice", "new-password"); code == http.StatusProxyAuthRequired {
+		t.Error("the users are changed by a bad config")
+	}
+
+	// close_disallowed closes the existing connections of the denied peers.
+	write(`p2p_host: "p2p.to"
+acl:
+  deny_peers: [%q]
+  close_disallowed: true
+proxy:
+  addr: %q
+  users:
+    - username: alice
+      password: new-password
+`, remote.ID(), addr)
+	if res, err = r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if res.ClosedConns != 1 || len(res.RestartRequired) != 0 {
+		t.Errorf("Reload() = %+v, want 1 closed connection and no restart", res)
+	}
+	if len(h.Network().ConnsToPeer(remote.ID())) != 0 {
+		t.Error("the connection of the denied peer is not closed")
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/p2pdao/libp2p-proxy/config"
+	"github.com/p2pdao/libp2p-proxy/protocol"
+)
+
+// newSite returns the http handler of a static root or an upstream url,
+// and the http.Server with the site timeouts.
+func newSite(site config.SiteConfig) (http.Handler, *http.Server, error) {
+	var handler http.Handler
+	var s *http.Server
+
+	switch {
+	case site.ServePath != "" && site.ServeUpstream != "":
+		return nil, nil, fmt.Errorf("serve_path and serve_upstream can't be used together")
+
+	case site.ServePath != "":
+		handler = newStatic(site.ServePath)
+		s = protocol.NewHTTPServer()
+
+	case site.ServeUpstream != "":
+		rp, err := newUpstream(site.ServeUpstream)
+		if err != nil {
+			return nil, nil, err
+		}
+		handler = rp
+		s = newUpstreamServer()
+
+	default:
+		return nil, nil, fmt.Errorf("serve_path or serve_upstream is required")
+	}
+
+	setTimeout(&s.ReadHeaderTimeout, site.ReadHeaderTimeout)
+	setTimeout(&s.ReadTimeout, site.ReadTimeout)
+	setTimeout(&s.WriteTimeout, site.WriteTimeout)
+	setTimeout(&s.IdleTimeout, site.IdleTimeout)
+	return handler, s, nil
+}
+
+// serveSites serves the named sites on their own protocols in background.
+func serveSites(proxy *protocol.ProxyService, sites map[string]config.SiteConfig) {
+	for name, site := range sites {
+		if !config.ValidSiteName(name) {
+			protocol.Log.Fatalf("invalid site name: %q", name)
+		}
+
+		handler, s, err := newSite(site)
+		if err != nil {
+			protocol.Log.Fatalf("site %s: %v", name, err)
+		}
+
+		pid := protocol.SiteID(name)
+		if site.ServePath != "" {
+			fmt.Printf("Serve HTTP site %s static: %s\n", pid, handler)
+		} else {
+			fmt.Printf("Serve HTTP site %s upstream: %s\n", pid, site.ServeUpstream)
+		}
+		go func() {
+			if err := proxy.ServeHTTPProtocol(pid, handler, s); err != nil && err != http.ErrServerClosed {
+				protocol.Log.Fatal(err)
+			}
+		}()
+	}
+}
+
+func setTimeout(d *time.Duration, seconds int) {
+	if seconds > 0 {
+		*d = time.Duration(seconds) * time.Second
+	}
+}
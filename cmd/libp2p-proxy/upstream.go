@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"time"
+
+	"github.com/p2pdao/libp2p-proxy/protocol"
+)
+
+// newUpstream returns a reverse proxy to the local http backend, the remote peer ID
+// reaches the backend in the protocol.PeerIDHeader header.
+func newUpstream(rawURL string) (*httputil.ReverseProxy, error) {
+	target, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return nil, fmt.Errorf("invalid upstream url: %s", rawURL)
+	}
+
+	rp := httputil.NewSingleHostReverseProxy(target)
+	director := rp.Director
+	rp.Director = func(r *http.Request) {
+		host := r.Host
+		director(r)
+		r.Host = target.Host
+		r.Header.Set("X-Forwarded-Host", host)
+		r.Header.Set("X-Forwarded-Proto", "http")
+	}
+	// flush immediately for streaming responses, such as server-sent events.
+	rp.FlushInterval = -1
+	rp.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		protocol.Log.Warnf("upstream %s error: %v", r.URL, err)
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	return rp, nil
+}
+
+// newUpstreamServer has no read and write timeouts,
+// that would break streaming responses and WebSocket connections.
+func newUpstreamServer() *http.Server {
+	return &http.Server{
+		ReadHeaderTimeout: 20 * time.Second,
+		IdleTimeout:       90 * time.Second,
+	}
+}
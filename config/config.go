@@ -7,39 +7,183 @@ import (
 	"path/filepath"
 	"strings"
 
+	"github.com/BurntSushi/toml"
 	yaml "gopkg.in/yaml.v2"
 )
 
 type Config struct {
-	PeerKey   string        `json:"peer_key" yaml:"peer_key"`
-	P2PHost   string        `json:"p2p_host" yaml:"p2p_host"`
-	ServePath string        `json:"serve_path" yaml:"serve_path"`
-	Network   NetworkConfig `json:"network" yaml:"network"`
-	DHT       DHTConfig     `json:"dht" yaml:"dht"`
-	ACL       ACLConfig     `json:"acl" yaml:"acl"`
-	Proxy     *ProxyConfig  `json:"proxy" yaml:"proxy"`
+	PeerKey          string                `json:"peer_key" yaml:"peer_key" toml:"peer_key"`
+	PeerKeyFile      string                `json:"peer_key_file" yaml:"peer_key_file" toml:"peer_key_file"` // read into PeerKey by Load
+	P2PHost          string                `json:"p2p_host" yaml:"p2p_host" toml:"p2p_host"`
+	ServePath        string                `json:"serve_path" yaml:"serve_path" toml:"serve_path"`
+	ServeUpstream    string                `json:"serve_upstream" yaml:"serve_upstream" toml:"serve_upstream"`
+	Sites            map[string]SiteConfig `json:"sites" yaml:"sites" toml:"sites"`
+	ForwardedHeaders ForwardedConfig       `json:"forwarded_headers" yaml:"forwarded_headers" toml:"forwarded_headers"`
+	Forwards         []ForwardConfig       `json:"forwards" yaml:"forwards" toml:"forwards"`
+	Network          NetworkConfig         `json:"network" yaml:"network" toml:"network"`
+	DHT              DHTConfig             `json:"dht" yaml:"dht" toml:"dht"`
+	Discovery        DiscoveryConfig       `json:"discovery" yaml:"discovery" toml:"discovery"`
+	ACL              ACLConfig             `json:"acl" yaml:"acl" toml:"acl"`
+	Egress           EgressConfig          `json:"egress" yaml:"egress" toml:"egress"`
+	RelayService     RelayServiceConfig    `json:"relay_service" yaml:"relay_service" toml:"relay_service"`
+	Admin            AdminConfig           `json:"admin" yaml:"admin" toml:"admin"`
+	Proxy            *ProxyConfig          `json:"proxy" yaml:"proxy" toml:"proxy"`
+	Proxies          []ProxyConfig         `json:"proxies" yaml:"proxies" toml:"proxies"`
 }
 
+// AdminConfig is the local admin API, it is disabled if Addr is empty.
+type AdminConfig struct {
+	Addr  string `json:"addr" yaml:"addr" toml:"addr"`
+	Token string `json:"token" yaml:"token" toml:"token"` // required as a Bearer token if set
+}
+
+// ProxyConfig is a local proxy listener, it serves the clients in standalone mode
+// without ServerPeer, ServerPeers and Discover.
 type ProxyConfig struct {
-	Addr       string `json:"addr" yaml:"addr"`
-	ServerPeer string `json:"server_peer" yaml:"server_peer"`
+	Addr       string       `json:"addr" yaml:"addr" toml:"addr"`
+	ServerPeer string       `json:"server_peer" yaml:"server_peer" toml:"server_peer"`
+	Users      []UserConfig `json:"users" yaml:"users" toml:"users"`
+	Protocols  []string     `json:"protocols" yaml:"protocols" toml:"protocols"` // "http", "socks5" and "socks4", empty allows all
+
+	// more server peers with ServerPeer, the streams are opened by the strategy
+	ServerPeers         []string `json:"server_peers" yaml:"server_peers" toml:"server_peers"`
+	Strategy            string   `json:"strategy" yaml:"strategy" toml:"strategy"`                                        // "failover", "round-robin", "least-latency" or "least-connections"
+	HealthCheckInterval int      `json:"health_check_interval" yaml:"health_check_interval" toml:"health_check_interval"` // seconds, 0 uses the default
+	Discover            bool     `json:"discover" yaml:"discover" toml:"discover"`                                        // adds the server peers found by Discovery
+}
+
+// Standalone reports whether the listener serves the clients itself.
+func (pc ProxyConfig) Standalone() bool {
+	return pc.ServerPeer == "" && len(pc.ServerPeers) == 0 && !pc.Discover
+}
+
+// ServerPeerAddrs returns the multiaddrs or peer IDs of ServerPeer and
+// ServerPeers, empty in standalone mode.
+func (pc ProxyConfig) ServerPeerAddrs() []string {
+	addrs := make([]string, 0, len(pc.ServerPeers)+1)
+	if pc.ServerPeer != "" {
+		addrs = append(addrs, pc.ServerPeer)
+	}
+	return append(addrs, pc.ServerPeers...)
+}
+
+type UserConfig struct {
+	Username string `json:"username" yaml:"username" toml:"username"`
+	Password string `json:"password" yaml:"password" toml:"password"` // plain text or bcrypt hash
+}
+
+// SiteConfig is a named http site served on /x/$name/http,
+// the timeouts are in seconds, 0 uses the default.
+type SiteConfig struct {
+	ServePath         string `json:"serve_path" yaml:"serve_path" toml:"serve_path"`
+	ServeUpstream     string `json:"serve_upstream" yaml:"serve_upstream" toml:"serve_upstream"`
+	ReadHeaderTimeout int    `json:"read_header_timeout" yaml:"read_header_timeout" toml:"read_header_timeout"`
+	ReadTimeout       int    `json:"read_timeout" yaml:"read_timeout" toml:"read_timeout"`
+	WriteTimeout      int    `json:"write_timeout" yaml:"write_timeout" toml:"write_timeout"`
+	IdleTimeout       int    `json:"idle_timeout" yaml:"idle_timeout" toml:"idle_timeout"`
+}
+
+type ForwardedConfig struct {
+	Via           bool `json:"via" yaml:"via" toml:"via"`
+	Forwarded     bool `json:"forwarded" yaml:"forwarded" toml:"forwarded"`
+	XForwardedFor bool `json:"x_forwarded_for" yaml:"x_forwarded_for" toml:"x_forwarded_for"`
+}
+
+// ForwardConfig is a named TCP port forwarding between two peers, the peer with
+// Listen accepts local connections and tunnels them to Peer, the peer with Target
+// dials it for the forwarded connections.
+type ForwardConfig struct {
+	Name   string `json:"name" yaml:"name" toml:"name"`
+	Listen string `json:"listen" yaml:"listen" toml:"listen"`
+	Peer   string `json:"peer" yaml:"peer" toml:"peer"` // peer ID or full multiaddr
+	Target string `json:"target" yaml:"target" toml:"target"`
 }
 
 type NetworkConfig struct {
-	EnableNAT     bool     `json:"enable_nat" yaml:"enable_nat"`
-	ListenAddrs   []string `json:"listen_addrs" yaml:"listen_addrs"`
-	ExternalAddrs []string `json:"external_addrs" yaml:"external_addrs"`
-	Relays        []string `json:"relays" yaml:"relays"`
+	EnableNAT     bool     `json:"enable_nat" yaml:"enable_nat" toml:"enable_nat"`
+	ListenAddrs   []string `json:"listen_addrs" yaml:"listen_addrs" toml:"listen_addrs"`
+	ExternalAddrs []string `json:"external_addrs" yaml:"external_addrs" toml:"external_addrs"`
+	Relays        []string `json:"relays" yaml:"relays" toml:"relays"`
 }
 
 type ACLConfig struct {
-	AllowPeers   []string `json:"allow_peers" yaml:"allow_peers"`
-	AllowSubnets []string `json:"allow_subnets" yaml:"allow_subnets"`
+	AllowPeers   []string `json:"allow_peers" yaml:"allow_peers" toml:"allow_peers"`
+	AllowSubnets []string `json:"allow_subnets" yaml:"allow_subnets" toml:"allow_subnets"`
+	DenyPeers    []string `json:"deny_peers" yaml:"deny_peers" toml:"deny_peers"`
+	DenySubnets  []string `json:"deny_subnets" yaml:"deny_subnets" toml:"deny_subnets"`
+	// CloseDisallowed closes the existing connections of the disallowed peers on reload.
+	CloseDisallowed bool                    `json:"close_disallowed" yaml:"close_disallowed" toml:"close_disallowed"`
+	DefaultPolicy   string                  `json:"default_policy" yaml:"default_policy" toml:"default_policy"`
+	Policies        map[string]PolicyConfig `json:"policies" yaml:"policies" toml:"policies"`
+}
+
+// PolicyConfig is a named set of capabilities for its peers, a nil Egress uses
+// the global egress config, Bandwidth is in bytes per second for each peer, 0 is unlimited.
+type PolicyConfig struct {
+	Peers     []string      `json:"peers" yaml:"peers" toml:"peers"`
+	Proxy     bool          `json:"proxy" yaml:"proxy" toml:"proxy"`
+	P2PHttp   bool          `json:"p2phttp" yaml:"p2phttp" toml:"p2phttp"`
+	Forwards  []string      `json:"forwards" yaml:"forwards" toml:"forwards"` // forward names, "*" allows all
+	Egress    *EgressConfig `json:"egress" yaml:"egress" toml:"egress"`
+	Bandwidth int64         `json:"bandwidth" yaml:"bandwidth" toml:"bandwidth"`
+}
+
+// EgressConfig restricts the destinations the proxy dials for its clients,
+// the private ranges are denied unless AllowPrivate or AllowSubnets allows them.
+type EgressConfig struct {
+	AllowHosts   []string `json:"allow_hosts" yaml:"allow_hosts" toml:"allow_hosts"` // "example.com", ".example.com" or "*.example.com"
+	DenyHosts    []string `json:"deny_hosts" yaml:"deny_hosts" toml:"deny_hosts"`
+	AllowSubnets []string `json:"allow_subnets" yaml:"allow_subnets" toml:"allow_subnets"`
+	DenySubnets  []string `json:"deny_subnets" yaml:"deny_subnets" toml:"deny_subnets"`
+	AllowPorts   []string `json:"allow_ports" yaml:"allow_ports" toml:"allow_ports"` // "443" or "8000-9000"
+	AllowPrivate bool     `json:"allow_private" yaml:"allow_private" toml:"allow_private"`
+}
+
+// RelayServiceConfig is the circuit v2 relay service, the durations are in seconds,
+// 0 uses the default of go-libp2p.
+type RelayServiceConfig struct {
+	Enable                 bool  `json:"enable" yaml:"enable" toml:"enable"`
+	UseACL                 bool  `json:"use_acl" yaml:"use_acl" toml:"use_acl"`
+	ReservationTTL         int   `json:"reservation_ttl" yaml:"reservation_ttl" toml:"reservation_ttl"`
+	MaxReservations        int   `json:"max_reservations" yaml:"max_reservations" toml:"max_reservations"`
+	MaxReservationsPerPeer int   `json:"max_reservations_per_peer" yaml:"max_reservations_per_peer" toml:"max_reservations_per_peer"`
+	MaxReservationsPerIP   int   `json:"max_reservations_per_ip" yaml:"max_reservations_per_ip" toml:"max_reservations_per_ip"`
+	MaxReservationsPerASN  int   `json:"max_reservations_per_asn" yaml:"max_reservations_per_asn" toml:"max_reservations_per_asn"`
+	MaxCircuits            int   `json:"max_circuits" yaml:"max_circuits" toml:"max_circuits"`
+	BufferSize             int   `json:"buffer_size" yaml:"buffer_size" toml:"buffer_size"`
+	CircuitDuration        int   `json:"circuit_duration" yaml:"circuit_duration" toml:"circuit_duration"`
+	CircuitData            int64 `json:"circuit_data" yaml:"circuit_data" toml:"circuit_data"` // bytes in each direction
 }
 
 type DHTConfig struct {
-	DatastorePath  string   `json:"datastore_path" yaml:"datastore_path"`
-	BootstrapPeers []string `json:"bootstrap_peers" yaml:"bootstrap_peers"`
+	DatastorePath  string   `json:"datastore_path" yaml:"datastore_path" toml:"datastore_path"`
+	BootstrapPeers []string `json:"bootstrap_peers" yaml:"bootstrap_peers" toml:"bootstrap_peers"`
+	ClientSide     bool     `json:"client_side" yaml:"client_side" toml:"client_side"` // runs it on the client side to find the peers by peer ID
+}
+
+// DiscoveryConfig finds the proxy server peers of a network by the DHT, or on
+// the local network by mDNS. The servers advertise themselves and the clients
+// look them up.
+type DiscoveryConfig struct {
+	Network    string   `json:"network" yaml:"network" toml:"network"`             // the namespace is "p2pdao.libp2p-proxy/$network"
+	Advertise  bool     `json:"advertise" yaml:"advertise" toml:"advertise"`       // server side
+	MDNS       bool     `json:"mdns" yaml:"mdns" toml:"mdns"`                      // advertise or find the peers on the local network
+	AllowPeers []string `json:"allow_peers" yaml:"allow_peers" toml:"allow_peers"` // client side, empty allows all
+}
+
+// ProxyListeners returns the proxy listeners of Proxy and Proxies.
+func (c *Config) ProxyListeners() []ProxyConfig {
+	listeners := make([]ProxyConfig, 0, len(c.Proxies)+1)
+	if c.Proxy != nil {
+		listeners = append(listeners, *c.Proxy)
+	}
+	return append(listeners, c.Proxies...)
+}
+
+// ClientSide reports whether the peer runs the proxy listeners, in client side
+// or standalone mode, instead of the server side.
+func (c *Config) ClientSide() bool {
+	return c.Proxy != nil || len(c.Proxies) > 0
 }
 
 func Default() Config {
@@ -65,15 +209,11 @@ func LoadConfig(cfgPath string) (Config, error) {
 
 		data, err := ioutil.ReadFile(cfgPath)
 		if err != nil {
-			panic(err)
+			return Config{}, err
 		}
 
-		err = parseConfig(data, ext, &cfg)
-		if err != nil {
-			panic(err)
-		}
-		if err != nil {
-			return Config{}, err
+		if err = parseConfig(data, ext, &cfg); err != nil {
+			return Config{}, fmt.Errorf("parse config %s: %w", cfgPath, err)
 		}
 	}
 
@@ -92,6 +232,8 @@ func parseConfig(data []byte, ext string, v interface{}) error {
 		unmarshal = json.Unmarshal
 	case "yaml", "yml":
 		unmarshal = yaml.Unmarshal
+	case "toml":
+		unmarshal = toml.Unmarshal
 	default:
 		return fmt.Errorf("not supported config ext: %s", ext)
 	}
@@ -0,0 +1,249 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// EnvPrefix is the prefix of the environment variables of the config keys,
+// such as LIBP2P_PROXY_PROXY_ADDR for proxy.addr.
+const EnvPrefix = "LIBP2P_PROXY_"
+
+const redacted = "<redacted>"
+
+// Load loads the config in layers: the defaults, the config file, the
+// LIBP2P_PROXY_* environment variables and the command line overrides,
+// the later layers take precedence. o can be nil.
+func Load(path string, o *Overrides) (Config, error) {
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		return Config{}, err
+	}
+	if cfg.PeerKey != "" && cfg.PeerKeyFile != "" {
+		return Config{}, fmt.Errorf("peer_key and peer_key_file can't be used together")
+	}
+
+	var env [][2]string
+	for _, key := range Keys() {
+		if value, ok := os.LookupEnv(EnvName(key)); ok {
+			env = append(env, [2]string{key, value})
+		}
+	}
+	if err := cfg.setLayer(env, func(key string) string { return "env " + EnvName(key) }); err != nil {
+		return Config{}, err
+	}
+
+	if o != nil {
+		if err := cfg.setLayer(o.values, func(key string) string { return "flag -" + key }); err != nil {
+			return Config{}, err
+		}
+	}
+
+	if cfg.PeerKeyFile != "" {
+		data, err := ioutil.ReadFile(cfg.PeerKeyFile)
+		if err != nil {
+			return Config{}, fmt.Errorf("read peer_key_file: %w", err)
+		}
+		cfg.PeerKey = strings.TrimSpace(string(data))
+	}
+	return cfg, nil
+}
+
+// setLayer sets the values of a layer, source names the key in the errors.
+// peer_key and peer_key_file can't be set by the same layer, setting one of
+// them clears the other set by the lower layers.
+func (c *Config) setLayer(values [][2]string, source func(key string) string) error {
+	set := make(map[string]bool, len(values))
+	for _, kv := range values {
+		if err := c.Set(kv[0], kv[1]); err != nil {
+			return fmt.Errorf("%s: %w", source(kv[0]), err)
+		}
+		set[kv[0]] = true
+	}
+
+	switch {
+	case set["peer_key"] && set["peer_key_file"]:
+		return fmt.Errorf("%s and %s can't be used together", source("peer_key"), source("peer_key_file"))
+	case set["peer_key"]:
+		c.PeerKeyFile = ""
+	case set["peer_key_file"]:
+		c.PeerKey = ""
+	}
+	return nil
+}
+
+// Keys returns the keys of every config field, the fields of the nested structs
+// are joined by ".", the lists and maps are set as a whole.
+func Keys() []string {
+	var keys []string
+	walkKeys(reflect.TypeOf(Config{}), "", func(key string, _ reflect.Type) {
+		keys = append(keys, key)
+	})
+	return keys
+}
+
+// EnvName returns the environment variable of the config key.
+func EnvName(key string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+// Set sets the config field of the key, the value of a list of strings is
+// comma separated, the value of the other lists, maps and numbers is YAML,
+// such as `{blog: {serve_path: ./blog}}` for sites.
+func (c *Config) Set(key, value string) error {
+	v := reflect.ValueOf(c).Elem()
+	for _, name := range strings.Split(key, ".") {
+		if v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		if v.Kind() != reflect.Struct {
+			return fmt.Errorf("unknown config key: %s", key)
+		}
+		i := fieldIndex(v.Type(), name)
+		if i < 0 {
+			return fmt.Errorf("unknown config key: %s", key)
+		}
+		v = v.Field(i)
+	}
+
+	switch {
+	case v.Kind() == reflect.String:
+		v.SetString(value)
+
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.String &&
+		!strings.HasPrefix(strings.TrimSpace(value), "["):
+		ss := []string{}
+		for _, s := range strings.Split(value, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				ss = append(ss, s)
+			}
+		}
+		v.Set(reflect.ValueOf(ss))
+
+	case v.Kind() == reflect.Struct || (v.Kind() == reflect.Ptr && v.Type().Elem().Kind() == reflect.Struct):
+		return fmt.Errorf("unknown config key: %s", key)
+
+	default:
+		nv := reflect.New(v.Type())
+		if err := yaml.Unmarshal([]byte(value), nv.Interface()); err != nil {
+			return fmt.Errorf("invalid value for %s: %w", key, err)
+		}
+		v.Set(nv.Elem())
+	}
+	return nil
+}
+
+// Redacted returns a copy of the config with the secrets replaced.
+func (c Config) Redacted() Config {
+	if c.PeerKey != "" {
+		c.PeerKey = redacted
+	}
+	if c.Admin.Token != "" {
+		c.Admin.Token = redacted
+	}
+	if c.Proxy != nil {
+		proxy := c.Proxy.redacted()
+		c.Proxy = &proxy
+	}
+	proxies := make([]ProxyConfig, len(c.Proxies))
+	for i, pc := range c.Proxies {
+		proxies[i] = pc.redacted()
+	}
+	c.Proxies = proxies
+	return c
+}
+
+func (pc ProxyConfig) redacted() ProxyConfig {
+	users := make([]UserConfig, len(pc.Users))
+	for i, u := range pc.Users {
+		u.Password = redacted
+		users[i] = u
+	}
+	pc.Users = users
+	return pc
+}
+
+// Overrides is the config values set by the command line flags, in order.
+type Overrides struct {
+	values [][2]string
+}
+
+// RegisterFlags registers a flag for every config key on fs, such as
+// -proxy.addr, the parsed values are applied by Load.
+func RegisterFlags(fs *flag.FlagSet) *Overrides {
+	o := &Overrides{}
+	walkKeys(reflect.TypeOf(Config{}), "", func(key string, t reflect.Type) {
+		fs.Var(&overrideFlag{o: o, key: key, bool: t.Kind() == reflect.Bool}, key,
+			fmt.Sprintf("config %s, env %s", key, EnvName(key)))
+	})
+	return o
+}
+
+// Set adds the override of the config key.
+func (o *Overrides) Set(key, value string) error {
+	// check the key and value early.
+	var cfg Config
+	if err := cfg.Set(key, value); err != nil {
+		return err
+	}
+	o.values = append(o.values, [2]string{key, value})
+	return nil
+}
+
+type overrideFlag struct {
+	o    *Overrides
+	key  string
+	bool bool
+}
+
+func (f *overrideFlag) String() string { return "" }
+
+func (f *overrideFlag) Set(value string) error { return f.o.Set(f.key, value) }
+
+func (f *overrideFlag) IsBoolFlag() bool { return f.bool }
+
+func walkKeys(t reflect.Type, prefix string, fn func(key string, t reflect.Type)) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := yamlName(f)
+		if name == "" {
+			continue
+		}
+
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr && ft.Elem().Kind() == reflect.Struct {
+			ft = ft.Elem()
+		}
+		if ft.Kind() == reflect.Struct {
+			walkKeys(ft, prefix+name+".", fn)
+		} else {
+			fn(prefix+name, ft)
+		}
+	}
+}
+
+func fieldIndex(t reflect.Type, name string) int {
+	for i := 0; i < t.NumField(); i++ {
+		if yamlName(t.Field(i)) == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func yamlName(f reflect.StructField) string {
+	name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+	if name == "-" {
+		return ""
+	}
+	return name
+}
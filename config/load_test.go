@@ -0,0 +1,202 @@
+package config
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadPeerKeyLayers(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "peer_key")
+	if err := os.WriteFile(keyFile, []byte("file-key\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	withKey := filepath.Join(dir, "with_key.yaml")
+	if err := os.WriteFile(withKey, []byte("peer_key: \"config-key\"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	withFile := filepath.Join(dir, "with_file.yaml")
+	if err := os.WriteFile(withFile, []byte("peer_key_file: \""+keyFile+"\"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	withBoth := filepath.Join(dir, "with_both.yaml")
+	if err := os.WriteFile(withBoth, []byte("peer_key: \"config-key\"\npeer_key_file: \""+keyFile+"\"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		path  string
+		env   map[string]string
+		flags [][2]string
+		key   string
+		err   string
+	}{
+		{name: "file key", path: withKey, key: "config-key"},
+		{name: "file key file", path: withFile, key: "file-key"},
+		{name: "file both", path: withBoth, err: "can't be used together"},
+		{name: "env key file over file key", path: withKey, env: map[string]string{"PEER_KEY_FILE": keyFile}, key: "file-key"},
+		{name: "env key over file key file", path: withFile, env: map[string]string{"PEER_KEY": "env-key"}, key: "env-key"},
+		{name: "flag key file over file key", path: withKey, flags: [][2]string{{"peer_key_file", keyFile}}, key: "file-key"},
+		{name: "flag key over env key file", path: withKey, env: map[string]string{"PEER_KEY_FILE": keyFile}, flags: [][2]string{{"peer_key", "flag-key"}}, key: "flag-key"},
+		{name: "env both", path: withKey, env: map[string]string{"PEER_KEY": "env-key", "PEER_KEY_FILE": keyFile}, err: "can't be used together"},
+		{name: "flags both", path: withKey, flags: [][2]string{{"peer_key", "flag-key"}, {"peer_key_file", keyFile}}, err: "can't be used together"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(EnvPrefix+k, v)
+			}
+			o := &Overrides{}
+			for _, kv := range tt.flags {
+				if err := o.Set(kv[0], kv[1]); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			cfg, err := Load(tt.path, o)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("Load() error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.PeerKey != tt.key {
+				t.Errorf("PeerKey = %q, want %q", cfg.PeerKey, tt.key)
+			}
+		})
+	}
+}
+
+func TestLoadLayers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(`p2p_host: "file.to"
+egress:
+  deny_hosts: ["file.example.com"]
+proxy:
+  addr: "127.0.0.1:1082"
+  protocols: ["http"]
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	empty := filepath.Join(t.TempDir(), "empty.yaml")
+	if err := os.WriteFile(empty, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		path  string
+		env   map[string]string
+		flags []string
+		get   func(c *Config) interface{}
+		want  interface{}
+		err   string
+	}{
+		{
+			name: "file", path: path,
+			get:  func(c *Config) interface{} { return c.Proxy.Addr },
+			want: "127.0.0.1:1082",
+		},
+		{
+			name: "env nested key over file", path: path, env: map[string]string{"PROXY_ADDR": "127.0.0.1:2000"},
+			get:  func(c *Config) interface{} { return c.Proxy.Addr },
+			want: "127.0.0.1:2000",
+		},
+		{
+			name: "env creates the nested struct", path: empty, env: map[string]string{"PROXY_ADDR": "127.0.0.1:2000"},
+			get:  func(c *Config) interface{} { return *c.Proxy },
+			want: ProxyConfig{Addr: "127.0.0.1:2000"},
+		},
+		{
+			name: "flag nested key", path: empty, flags: []string{"-proxy.server_peer", "QmPeer", "-dht.client_side"},
+			get:  func(c *Config) interface{} { return [2]interface{}{c.Proxy.ServerPeer, c.DHT.ClientSide} },
+			want: [2]interface{}{"QmPeer", true},
+		},
+		{
+			name: "flag over env", path: path,
+			env:   map[string]string{"PROXY_ADDR": "127.0.0.1:2000", "P2P_HOST": "env.to"},
+			flags: []string{"-proxy.addr=127.0.0.1:3000"},
+			get:   func(c *Config) interface{} { return [2]string{c.Proxy.Addr, c.P2PHost} },
+			want:  [2]string{"127.0.0.1:3000", "env.to"},
+		},
+		{
+			name: "bool flag over env", path: empty, env: map[string]string{"DHT_CLIENT_SIDE": "true"},
+			flags: []string{"-dht.client_side=false"},
+			get:   func(c *Config) interface{} { return c.DHT.ClientSide },
+			want:  false,
+		},
+		{
+			name: "comma separated list", path: path, env: map[string]string{"EGRESS_DENY_HOSTS": " a.example.com, b.example.com ,"},
+			get:  func(c *Config) interface{} { return c.Egress.DenyHosts },
+			want: []string{"a.example.com", "b.example.com"},
+		},
+		{
+			name: "yaml list", path: path, flags: []string{`-egress.deny_hosts=["a,b", "c"]`},
+			get:  func(c *Config) interface{} { return c.Egress.DenyHosts },
+			want: []string{"a,b", "c"},
+		},
+		{
+			name: "empty list", path: path, env: map[string]string{"PROXY_PROTOCOLS": ""},
+			get:  func(c *Config) interface{} { return c.Proxy.Protocols },
+			want: []string{},
+		},
+		{
+			name: "yaml list of structs", path: path, env: map[string]string{"PROXY_USERS": "[{username: alice, password: pw}]"},
+			get:  func(c *Config) interface{} { return c.Proxy.Users },
+			want: []UserConfig{{Username: "alice", Password: "pw"}},
+		},
+		{
+			name: "yaml map", path: empty, flags: []string{"-acl.policies={guest: {proxy: true, forwards: [ssh]}}"},
+			get:  func(c *Config) interface{} { return c.ACL.Policies },
+			want: map[string]PolicyConfig{"guest": {Proxy: true, Forwards: []string{"ssh"}}},
+		},
+		{
+			name: "yaml number", path: empty, env: map[string]string{"RELAY_SERVICE_MAX_CIRCUITS": "16"},
+			get:  func(c *Config) interface{} { return c.RelayService.MaxCircuits },
+			want: 16,
+		},
+		{
+			name: "invalid env value", path: empty, env: map[string]string{"RELAY_SERVICE_MAX_CIRCUITS": "many"},
+			err: "env LIBP2P_PROXY_RELAY_SERVICE_MAX_CIRCUITS: invalid value for relay_service.max_circuits",
+		},
+		{name: "invalid flag value", path: empty, flags: []string{"-relay_service.max_circuits=many"}, err: "invalid value"},
+		{name: "unknown flag", path: empty, flags: []string{"-proxy.unknown=1"}, err: "flag provided but not defined"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(EnvPrefix+k, v)
+			}
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			fs.SetOutput(io.Discard)
+			o := RegisterFlags(fs)
+
+			err := fs.Parse(tt.flags)
+			var cfg Config
+			if err == nil {
+				cfg, err = Load(tt.path, o)
+			}
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := tt.get(&cfg); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package config
+
+import (
+	"reflect"
+)
+
+// descriptions of the config fields by "TypeName.key", they follow the comments
+// of config_sample_full.yaml.
+var descriptions = map[string]string{
+	"Config":                   "libp2p-proxy config, the client side `proxy` can't be used together with the server side `serve_path`, `serve_upstream`, `sites` and `relay_service`.",
+	"Config.peer_key":          "Client & server side. The peer's private key, generated by `libp2p-proxy -key`. If omitted, a random one is generated.",
+	"Config.peer_key_file":     "Client & server side. The file with the peer_key, so the key needn't be in the config file. It can't be used together with `peer_key` in the same layer, the env or flag of one overrides the other.",
+	"Config.p2p_host":          "Client & server side. The host name of the p2p websites, such as http://p2p.to/p2p/$peer_id/http/. Default to \"p2p.to\".",
+	"Config.serve_path":        "Server side. The static files directory served over http on libp2p streams. Default to \"\", not running a http service.",
+	"Config.serve_upstream":    "Server side. The local http backend reverse proxied on libp2p streams, it supports streaming responses and WebSocket. It can't be used together with `serve_path`.",
+	"Config.sites":             "Server side. The named http services, every site is served on protocol `/x/$name/http` with its own http server.",
+	"Config.forwarded_headers": "Server side. Annotate the forwarded http requests, so that origin servers can tell which client the request came from.",
+	"Config.forwards":          "Client & server side. Forward TCP ports between peers like `ssh -L` and `ssh -R`.",
+	"Config.network":           "Server side. The libp2p network settings.",
+	"Config.dht":               "Server side (and standalone mode, `discovery` and `client_side`). Run DHT client to find peers.",
+	"Config.discovery":         "Client & server side. Find the proxy server peers by the DHT or mDNS without their addresses.",
+	"Config.acl":               "Server side. The peers allowed to access, and their policies.",
+	"Config.egress":            "Server side (and standalone mode). Restrict the destinations the proxy dials for the clients. Deny rules take precedence, a non-empty allow list restricts the destinations to it.",
+	"Config.relay_service":     "Server side. Run a circuit v2 relay for the peers behind NAT, the limits default to go-libp2p's, durations are in seconds.",
+	"Config.admin":             "Client & server side. The local admin API.",
+	"Config.proxy":             "Client side. The http and socks5 proxy listener, the peer runs in client side or standalone mode with it.",
+
+	"Config.proxies": "Client side. More proxy listeners like `proxy`, every listener has its own server peers, authentication and protocols, they share the libp2p host.",
+
+	"ProxyConfig.addr":                  "The listen address of the http and socks5 proxy. Default to \"127.0.0.1:1082\" with the -peer flag.",
+	"ProxyConfig.server_peer":           "The full multiaddr or the peer ID of the proxy server that the client connects to, a peer ID is found by the DHT. Default to empty, that means running in standalone mode.",
+	"ProxyConfig.users":                 "Username/password authentication on the proxy listener for socks5 (RFC 1929) and http (`Proxy-Authorization: Basic`) clients. Default to empty, that means no authentication.",
+	"ProxyConfig.protocols":             "The enabled protocols: \"http\", \"socks5\" and \"socks4\". Default to empty, that means all.",
+	"ProxyConfig.server_peers":          "More proxy servers with `server_peer`, the connections are spread over the healthy ones by the `strategy`, and retried on the next one if the stream can't be opened. The addresses are re-resolved by the DHT with `dht.client_side`.",
+	"ProxyConfig.strategy":              "\"failover\", \"round-robin\", \"least-latency\" or \"least-connections\". Default to \"failover\".",
+	"ProxyConfig.discover":              "Add the server peers found by `discovery` to the listener. Default to false.",
+	"ProxyConfig.health_check_interval": "Seconds, the server peers are pinged on the interval to keep the connections warm, the unhealthy ones are removed and reconnected with exponential backoff until a ping succeeds. 0 uses the default 30.",
+	"UserConfig.username":               "The username, 1 to 255 bytes.",
+	"UserConfig.password":               "The password in plain text or a bcrypt hash (`htpasswd -nbB user password`).",
+
+	"SiteConfig.serve_path":          "The static files directory of the site.",
+	"SiteConfig.serve_upstream":      "The local http backend of the site. It can't be used together with `serve_path`.",
+	"SiteConfig.read_header_timeout": "Seconds, 0 uses the default.",
+	"SiteConfig.read_timeout":        "Seconds, 0 uses the default.",
+	"SiteConfig.write_timeout":       "Seconds, 0 uses the default.",
+	"SiteConfig.idle_timeout":        "Seconds, 0 uses the default.",
+
+	"ForwardedConfig.via":             "Add the `Via` header. Default to false.",
+	"ForwardedConfig.forwarded":       "Add the `Forwarded` header with the peer ID as an obfuscated node, such as `for=_12D3KooW...`. Default to false.",
+	"ForwardedConfig.x_forwarded_for": "Add the `X-Forwarded-For` header. Default to false.",
+
+	"ForwardConfig.name":   "The forward name, the `listen` side and the `target` side are matched by it.",
+	"ForwardConfig.listen": "Accept local connections on the TCP address and tunnel them to the forward with the same `name` on `peer`.",
+	"ForwardConfig.peer":   "A peer ID or a full multiaddr. Default to the `server_peer` on client side. For a `target`, the only peer allowed.",
+	"ForwardConfig.target": "Dial the TCP address for the tunneled connections.",
+
+	"NetworkConfig.enable_nat":     "Enable the NAT port mapping and the NAT service. Default to false.",
+	"NetworkConfig.listen_addrs":   "The listen multiaddrs, invalid addrs are ignored.",
+	"NetworkConfig.external_addrs": "The external peer addrs for public accessing.",
+	"NetworkConfig.relays":         "The known relays for autorelay instead of the relays discovered by the DHT, every relay must be a full multiaddr with \"/p2p/\".",
+
+	"DHTConfig.datastore_path":  "The directory for storing data. Default to empty, that means using memory instead.",
+	"DHTConfig.bootstrap_peers": "The additional peers to connect to.",
+	"DHTConfig.client_side":     "Run the DHT client on the client side, so the server peers and the forward peers can be peer IDs only, and the addresses of the server peers are re-resolved when the known ones fail. Without it the client side peer only redials the configured addresses. Default to false, it is enabled by a server peer or a forward peer given by peer ID only.",
+
+	"DiscoveryConfig.network":     "The network name, the servers advertise the namespace \"p2pdao.libp2p-proxy/$network\" on the DHT. Default to \"\", that means disabled.",
+	"DiscoveryConfig.advertise":   "Server side. Advertise this peer as a proxy server of the network. Default to false.",
+	"DiscoveryConfig.mdns":        "Advertise the server peers on the local network by mDNS, and find them for the client side listeners with `discover`, they are preferred to the configured server peers. Default to false.",
+	"DiscoveryConfig.allow_peers": "Client side. The discovered server peers allowed to use. Default to empty, that means allow all, anyone can advertise the namespace.",
+
+	"ACLConfig.allow_peers":      "A white list of the client side peers allowed to access. Default to empty, that means allow all.",
+	"ACLConfig.allow_subnets":    "A white list of the subnets the client side peers are allowed to access from.",
+	"ACLConfig.deny_peers":       "A black list of peers, it takes precedence over the white lists and is also applied to the outbound dials.",
+	"ACLConfig.deny_subnets":     "A black list of subnets, it takes precedence over the white lists and is also applied to the outbound dials.",
+	"ACLConfig.close_disallowed": "Close the existing connections of the peers that are not allowed anymore on reload. Default to false.",
+	"ACLConfig.default_policy":   "The policy of the peers without policy. Default to \"\", that means they are allowed everything.",
+	"ACLConfig.policies":         "The named capabilities assigned to the listed `peers`, a capability is denied unless it is set.",
+
+	"PolicyConfig.peers":     "The peers of the policy, a peer can be in one policy only.",
+	"PolicyConfig.proxy":     "Allow the http and socks forward proxying.",
+	"PolicyConfig.p2phttp":   "Allow the http services of this peer and the p2p websites through the proxy.",
+	"PolicyConfig.forwards":  "The allowed forward names, \"*\" allows all.",
+	"PolicyConfig.egress":    "Replace the global `egress` config for the peers.",
+	"PolicyConfig.bandwidth": "The bytes per second of each peer, shared by its proxy, forward and http site streams, 0 is unlimited.",
+
+	"EgressConfig.allow_hosts":   "\"example.com\" is exact, \".example.com\" matches the domain and its subdomains, \"*.example.com\" is a glob. Default to empty, that means allow all.",
+	"EgressConfig.deny_hosts":    "The denied host names, the same patterns as `allow_hosts`.",
+	"EgressConfig.allow_subnets": "Checked on every resolved IP. Default to empty, that means allow all public IPs.",
+	"EgressConfig.deny_subnets":  "The denied subnets, checked on every resolved IP.",
+	"EgressConfig.allow_ports":   "The allowed ports \"443\" or port ranges \"8000-9000\". Default to empty, that means allow all.",
+	"EgressConfig.allow_private": "Allow the private, loopback and link-local ranges. Default to false.",
+
+	"RelayServiceConfig.enable":                    "Run the relay service. Default to false.",
+	"RelayServiceConfig.use_acl":                   "Restrict the reservations and relayed connections to the `acl` allow list. Default to false.",
+	"RelayServiceConfig.reservation_ttl":           "Seconds, the duration of a reservation.",
+	"RelayServiceConfig.max_reservations":          "The max active reservations.",
+	"RelayServiceConfig.max_reservations_per_peer": "The max active reservations of each peer.",
+	"RelayServiceConfig.max_reservations_per_ip":   "The max active reservations of each IP.",
+	"RelayServiceConfig.max_reservations_per_asn":  "The max active reservations of each ASN.",
+	"RelayServiceConfig.max_circuits":              "Open relayed connections for each peer.",
+	"RelayServiceConfig.buffer_size":               "The buffer size of each relayed connection in bytes.",
+	"RelayServiceConfig.circuit_duration":          "Seconds, a relayed connection is reset after the duration.",
+	"RelayServiceConfig.circuit_data":              "A relayed connection is reset after the bytes in each direction.",
+
+	"AdminConfig.addr":  "The listen address of the admin API, `POST /reload` re-reads the config like SIGHUP, `GET /status` lists the connection states of the proxy listeners. Default to \"\", that means disabled.",
+	"AdminConfig.token": "Required in the `Authorization: Bearer <token>` header if it is set, it must be set unless the `addr` is a loopback address.",
+}
+
+// Schema is a JSON Schema (draft-07) of the config, for the editor validation
+// of the config files.
+type Schema struct {
+	Schema               string             `json:"$schema,omitempty"`
+	Title                string             `json:"title,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Type                 interface{}        `json:"type,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	AdditionalProperties interface{}        `json:"additionalProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Minimum              *int               `json:"minimum,omitempty"`
+	Default              interface{}        `json:"default,omitempty"`
+}
+
+// JSONSchema returns the JSON Schema of Config, it is generated from the
+// struct fields, so it is in sync with the config.
+func JSONSchema() *Schema {
+	s := schemaOf(reflect.TypeOf(Config{}), reflect.ValueOf(Default()))
+	s.Schema = "http://json-schema.org/draft-07/schema#"
+	s.Title = "libp2p-proxy"
+	s.Description = descriptions["Config"]
+	return s
+}
+
+// schemaOf returns the schema of t, the non-zero fields of the valid def are the defaults.
+func schemaOf(t reflect.Type, def reflect.Value) *Schema {
+	s := &Schema{}
+	if def.IsValid() && !def.IsZero() {
+		switch t.Kind() {
+		case reflect.Struct:
+		case reflect.Slice, reflect.Map:
+			if def.Len() > 0 {
+				s.Default = def.Interface()
+			}
+		default:
+			s.Default = def.Interface()
+		}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		s = schemaOf(t.Elem(), reflect.Value{})
+		s.Type = []string{s.Type.(string), "null"}
+
+	case reflect.Struct:
+		s.Type = "object"
+		s.AdditionalProperties = false
+		s.Properties = make(map[string]*Schema, t.NumField())
+		for i := 0; i < t.NumField(); i++ {
+			name := yamlName(t.Field(i))
+			if name == "" {
+				continue
+			}
+			var fv reflect.Value
+			if def.IsValid() {
+				fv = def.Field(i)
+			}
+			ps := schemaOf(t.Field(i).Type, fv)
+			ps.Description = descriptions[t.Name()+"."+name]
+			s.Properties[name] = ps
+		}
+
+	case reflect.Map:
+		s.Type = "object"
+		s.AdditionalProperties = schemaOf(t.Elem(), reflect.Value{})
+
+	case reflect.Slice:
+		s.Type = "array"
+		s.Items = schemaOf(t.Elem(), reflect.Value{})
+
+	case reflect.String:
+		s.Type = "string"
+
+	case reflect.Bool:
+		s.Type = "boolean"
+
+	case reflect.Int, reflect.Int64:
+		s.Type = "integer"
+		zero := 0
+		s.Minimum = &zero
+	}
+	return s
+}
@@ -0,0 +1,110 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestSchemaDescriptions(t *testing.T) {
+	var walk func(path string, s *Schema)
+	walk = func(path string, s *Schema) {
+		if s == nil {
+			return
+		}
+		for _, name := range sortedKeys(s.Properties) {
+			p := s.Properties[name]
+			if p.Description == "" {
+				t.Errorf("%s%s: no description", path, name)
+			}
+			walk(path+name+".", p)
+		}
+		walk(path+"[].", s.Items)
+		if ap, ok := s.AdditionalProperties.(*Schema); ok {
+			walk(path+"*.", ap)
+		}
+	}
+	walk("", JSONSchema())
+}
+
+// TestSchemaSampleKeys checks every key of the full samples is in the schema,
+// and the samples are equivalent.
+func TestSchemaSampleKeys(t *testing.T) {
+	schema := JSONSchema()
+	for _, path := range []string{"config_sample_full.yaml", "config_sample_full.toml"} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var raw interface{}
+		if filepath.Ext(path) == ".toml" {
+			m := map[string]interface{}{}
+			_, err = toml.Decode(string(data), &m)
+			raw = m
+		} else {
+			err = yaml.Unmarshal(data, &raw)
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		for _, key := range unknownKeys("", raw, schema) {
+			t.Errorf("%s: %s is not in the schema", path, key)
+		}
+	}
+
+	yc, err := LoadConfig("config_sample_full.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc, err := LoadConfig("config_sample_full.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(yc, tc) {
+		t.Errorf("config_sample_full.toml differs from config_sample_full.yaml:\n%+v\n%+v", tc, yc)
+	}
+}
+
+// unknownKeys returns the keys of the decoded value v that are not in the schema s.
+func unknownKeys(path string, v interface{}, s *Schema) []string {
+	var keys []string
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			keys = append(keys, unknownKey(path, k, e, s)...)
+		}
+	case map[interface{}]interface{}:
+		for k, e := range v {
+			keys = append(keys, unknownKey(path, fmt.Sprint(k), e, s)...)
+		}
+	case []map[string]interface{}:
+		for _, e := range v {
+			keys = append(keys, unknownKeys(path+"[]", e, s.Items)...)
+		}
+	case []interface{}:
+		for _, e := range v {
+			keys = append(keys, unknownKeys(path+"[]", e, s.Items)...)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func unknownKey(path, key string, v interface{}, s *Schema) []string {
+	if path != "" {
+		path += "."
+	}
+	if ps, ok := s.Properties[key]; ok {
+		return unknownKeys(path+key, v, ps)
+	}
+	if ap, ok := s.AdditionalProperties.(*Schema); ok {
+		return unknownKeys(path+key, v, ap)
+	}
+	return []string{path + key}
+}
@@ -0,0 +1,519 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// the site name is a segment of /x/$name/http
+var siteNameRe = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// ValidSiteName reports whether the name can be used in the site protocol /x/$name/http.
+func ValidSiteName(name string) bool {
+	return siteNameRe.MatchString(name)
+}
+
+// FieldError is a problem of a config field, the Path is like "acl.allow_peers[1]".
+type FieldError struct {
+	Path string
+	Msg  string
+}
+
+func (e FieldError) Error() string {
+	return e.Path + ": " + e.Msg
+}
+
+// ValidationError is every problem found by Config.Validate.
+type ValidationError []FieldError
+
+func (e ValidationError) Error() string {
+	lines := make([]string, 0, len(e)+1)
+	lines = append(lines, fmt.Sprintf("invalid config, %d error(s):", len(e)))
+	for _, fe := range e {
+		lines = append(lines, "  "+fe.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Validate checks every field of the config, it returns a ValidationError
+// with all the problems, or nil.
+func (c *Config) Validate() error {
+	v := &validator{listeners: make(map[int][]listener)}
+	client := c.ClientSide()
+	listeners := c.ProxyListeners()
+
+	if c.PeerKey != "" {
+		if b, err := crypto.ConfigDecodeKey(c.PeerKey); err != nil {
+			v.add("peer_key", "invalid base64 key: %v", err)
+		} else if _, err := crypto.UnmarshalPrivateKey(b); err != nil {
+			v.add("peer_key", "invalid private key: %v", err)
+		}
+	}
+
+	if c.ServePath != "" && c.ServeUpstream != "" {
+		v.add("serve_upstream", "can't be used together with serve_path")
+	}
+	if c.ServeUpstream != "" {
+		v.upstream("serve_upstream", c.ServeUpstream)
+	}
+	for _, name := range sortedKeys(c.Sites) {
+		p, site := "sites."+name, c.Sites[name]
+		if !ValidSiteName(name) {
+			v.add(p, "invalid site name, it must match %s", siteNameRe)
+		}
+		switch {
+		case site.ServePath != "" && site.ServeUpstream != "":
+			v.add(p, "serve_path and serve_upstream can't be used together")
+		case site.ServePath == "" && site.ServeUpstream == "":
+			v.add(p, "serve_path or serve_upstream is required")
+		case site.ServeUpstream != "":
+			v.upstream(p+".serve_upstream", site.ServeUpstream)
+		}
+		v.nonNegative(p+".read_header_timeout", site.ReadHeaderTimeout)
+		v.nonNegative(p+".read_timeout", site.ReadTimeout)
+		v.nonNegative(p+".write_timeout", site.WriteTimeout)
+		v.nonNegative(p+".idle_timeout", site.IdleTimeout)
+	}
+
+	targets := make(map[string]bool)
+	for i, fw := range c.Forwards {
+		p := fmt.Sprintf("forwards[%d]", i)
+		if fw.Name == "" || len(fw.Name) > 255 || strings.ContainsAny(fw.Name, "\r\n") {
+			v.add(p+".name", "invalid forward name: %q", fw.Name)
+		}
+		if fw.Peer != "" {
+			v.peer(p+".peer", fw.Peer)
+		}
+
+		switch {
+		case fw.Listen != "" && fw.Target != "":
+			v.add(p, "listen and target can't be used together")
+		case fw.Listen != "":
+			v.listen(p+".listen", fw.Listen)
+			// the forward listeners tunnel to the server peer of the first proxy listener by default.
+			if fw.Peer == "" && (!client || len(listeners[0].ServerPeerAddrs()) == 0) {
+				v.add(p+".peer", "is required for listen without the server_peer of the first proxy")
+			}
+		case fw.Target != "":
+			v.hostPort(p+".target", fw.Target)
+			if targets[fw.Name] {
+				v.add(p+".name", "duplicate forward target %q", fw.Name)
+			}
+			targets[fw.Name] = true
+		default:
+			v.add(p, "listen or target is required")
+		}
+	}
+
+	for i, s := range c.Network.ListenAddrs {
+		p := fmt.Sprintf("network.listen_addrs[%d]", i)
+		// the client side peer doesn't listen on the network.
+		if addr := v.multiaddr(p, s); addr != nil && !client {
+			v.listenMultiaddr(p, addr)
+		}
+	}
+	for i, s := range c.Network.ExternalAddrs {
+		v.multiaddr(fmt.Sprintf("network.external_addrs[%d]", i), s)
+	}
+	for i, s := range c.Network.Relays {
+		p := fmt.Sprintf("network.relays[%d]", i)
+		if addr := v.p2pAddr(p, s); addr != nil {
+			if _, err := addr.ValueForProtocol(ma.P_CIRCUIT); err == nil {
+				v.add(p, "relay address can't be a circuit address")
+			}
+		}
+	}
+	for i, s := range c.DHT.BootstrapPeers {
+		v.p2pAddr(fmt.Sprintf("dht.bootstrap_peers[%d]", i), s)
+	}
+	if c.Discovery.Network == "" && c.Discovery.Advertise {
+		v.add("discovery.network", "is required for advertise")
+	}
+	for i, s := range c.Discovery.AllowPeers {
+		v.peerID(fmt.Sprintf("discovery.allow_peers[%d]", i), s)
+	}
+
+	v.acl("acl", c.ACL)
+	v.egress("egress", c.Egress)
+
+	rs := c.RelayService
+	v.nonNegative("relay_service.reservation_ttl", rs.ReservationTTL)
+	v.nonNegative("relay_service.max_reservations", rs.MaxReservations)
+	v.nonNegative("relay_service.max_reservations_per_peer", rs.MaxReservationsPerPeer)
+	v.nonNegative("relay_service.max_reservations_per_ip", rs.MaxReservationsPerIP)
+	v.nonNegative("relay_service.max_reservations_per_asn", rs.MaxReservationsPerASN)
+	v.nonNegative("relay_service.max_circuits", rs.MaxCircuits)
+	v.nonNegative("relay_service.buffer_size", rs.BufferSize)
+	v.nonNegative("relay_service.circuit_duration", rs.CircuitDuration)
+	if rs.CircuitData < 0 {
+		v.add("relay_service.circuit_data", "must not be negative")
+	}
+
+	if c.Admin.Addr != "" {
+		v.admin("admin", c.Admin)
+	}
+
+	discovery := c.Discovery.Network != "" || c.Discovery.MDNS
+	if c.Proxy != nil {
+		v.proxy("proxy", *c.Proxy, discovery)
+	}
+	for i, pc := range c.Proxies {
+		v.proxy(fmt.Sprintf("proxies[%d]", i), pc, discovery)
+	}
+
+	if len(v.errs) > 0 {
+		return v.errs
+	}
+	return nil
+}
+
+// ParsePortRange parses a port "443" or a port range "8000-9000".
+func ParsePortRange(s string) (from, to int, err error) {
+	f, t, ok := strings.Cut(s, "-")
+	if !ok {
+		t = f
+	}
+
+	from, err1 := strconv.Atoi(strings.TrimSpace(f))
+	to, err2 := strconv.Atoi(strings.TrimSpace(t))
+	if err1 != nil || err2 != nil || from < 1 || to > 65535 || from > to {
+		return 0, 0, fmt.Errorf("invalid port range: %q", s)
+	}
+	return from, to, nil
+}
+
+type listener struct {
+	path string
+	host string
+}
+
+type validator struct {
+	errs      ValidationError
+	listeners map[int][]listener // TCP listeners by port
+}
+
+// Warnings returns the settings that are valid but ignored, such as the server
+// side settings of a client side peer, so a config can list every setting.
+func (c *Config) Warnings() []FieldError {
+	if !c.ClientSide() {
+		return nil
+	}
+
+	var warns []FieldError
+	for _, s := range []struct {
+		path string
+		set  bool
+	}{
+		{"serve_path", c.ServePath != ""},
+		{"serve_upstream", c.ServeUpstream != ""},
+		{"sites", len(c.Sites) > 0},
+		{"relay_service.enable", c.RelayService.Enable},
+		{"discovery.advertise", c.Discovery.Advertise},
+	} {
+		if s.set {
+			warns = append(warns, FieldError{Path: s.path, Msg: "is server side config, it is ignored with proxy or proxies"})
+		}
+	}
+	return warns
+}
+
+func (v *validator) add(path, format string, args ...interface{}) {
+	v.errs = append(v.errs, FieldError{Path: path, Msg: fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) nonNegative(path string, n int) {
+	if n < 0 {
+		v.add(path, "must not be negative")
+	}
+}
+
+func (v *validator) peerID(path, s string) {
+	if _, err := peer.Decode(s); err != nil {
+		v.add(path, "invalid peer ID %q: %v", s, err)
+	}
+}
+
+func (v *validator) multiaddr(path, s string) ma.Multiaddr {
+	addr, err := ma.NewMultiaddr(s)
+	if err != nil {
+		v.add(path, "invalid multiaddr %q: %v", s, err)
+		return nil
+	}
+	return addr
+}
+
+// p2pAddr checks a multiaddr with the /p2p/ peer ID.
+func (v *validator) p2pAddr(path, s string) ma.Multiaddr {
+	addr := v.multiaddr(path, s)
+	if addr == nil {
+		return nil
+	}
+	if _, err := peer.AddrInfoFromP2pAddr(addr); err != nil {
+		v.add(path, "invalid peer address %q: %v", s, err)
+		return nil
+	}
+	return addr
+}
+
+// peer checks a peer ID or a multiaddr with the /p2p/ peer ID, it returns
+// the peer ID, or "" if invalid.
+func (v *validator) peer(path, s string) peer.ID {
+	if !strings.HasPrefix(s, "/") {
+		id, err := peer.Decode(s)
+		if err != nil {
+			v.add(path, "invalid peer ID %q: %v", s, err)
+		}
+		return id
+	}
+	if addr := v.p2pAddr(path, s); addr != nil {
+		pi, _ := peer.AddrInfoFromP2pAddr(addr)
+		return pi.ID
+	}
+	return ""
+}
+
+func (v *validator) cidr(path, s string) {
+	if _, _, err := net.ParseCIDR(s); err != nil {
+		v.add(path, "invalid CIDR %q", s)
+	}
+}
+
+func (v *validator) hostPort(path, s string) (string, int, bool) {
+	host, portStr, err := net.SplitHostPort(s)
+	if err != nil {
+		v.add(path, "invalid address %q: %v", s, err)
+		return "", 0, false
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 65535 {
+		v.add(path, "invalid port in address %q", s)
+		return "", 0, false
+	}
+	return host, port, true
+}
+
+func (v *validator) upstream(path, s string) {
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		v.add(path, "invalid upstream url %q, it must be http:// or https://", s)
+	}
+}
+
+// listen checks the TCP listen address, and that it doesn't conflict with the others.
+func (v *validator) listen(path, s string) {
+	if host, port, ok := v.hostPort(path, s); ok {
+		v.addListener(listener{path: path, host: host}, port)
+	}
+}
+
+// admin requires the token unless the admin API listens on the loopback only.
+func (v *validator) admin(path string, c AdminConfig) {
+	host, port, ok := v.hostPort(path+".addr", c.Addr)
+	if !ok {
+		return
+	}
+	v.addListener(listener{path: path + ".addr", host: host}, port)
+	if c.Token != "" {
+		return
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		v.add(path+".token", "is required for the non-loopback address %q", c.Addr)
+	}
+}
+
+func (v *validator) listenMultiaddr(path string, addr ma.Multiaddr) {
+	portStr, err := addr.ValueForProtocol(ma.P_TCP)
+	if err != nil {
+		return
+	}
+	port, _ := strconv.Atoi(portStr)
+	for _, code := range []int{ma.P_IP4, ma.P_IP6, ma.P_DNS, ma.P_DNS4, ma.P_DNS6} {
+		if host, err := addr.ValueForProtocol(code); err == nil {
+			v.addListener(listener{path: path, host: host}, port)
+			return
+		}
+	}
+}
+
+// addListener reports the conflict of the same TCP port on the same address.
+func (v *validator) addListener(l listener, port int) {
+	if port == 0 {
+		return
+	}
+	for _, prior := range v.listeners[port] {
+		if l.conflicts(prior) {
+			v.add(l.path, "listen address conflicts with %s", prior.path)
+			return
+		}
+	}
+	v.listeners[port] = append(v.listeners[port], l)
+}
+
+// conflicts reports whether the listeners on the same port overlap, an empty
+// host listens on every address, an unspecified IP on every address of its family.
+func (l listener) conflicts(o listener) bool {
+	if l.host == "" || o.host == "" || l.host == o.host {
+		return true
+	}
+
+	ip, oip := net.ParseIP(l.host), net.ParseIP(o.host)
+	switch {
+	case ip == nil && oip == nil:
+		return false
+	case ip == nil:
+		return oip.IsUnspecified()
+	case oip == nil:
+		return ip.IsUnspecified()
+	case ip.IsUnspecified() || oip.IsUnspecified():
+		return (ip.To4() == nil) == (oip.To4() == nil)
+	}
+	return ip.Equal(oip)
+}
+
+func (v *validator) proxy(path string, c ProxyConfig, discovery bool) {
+	if c.Addr == "" {
+		v.add(path+".addr", "is required")
+	} else {
+		v.listen(path+".addr", c.Addr)
+	}
+	serverPeers := make(map[peer.ID]bool)
+	serverPeer := func(p, s string) {
+		if id := v.peer(p, s); id != "" {
+			if serverPeers[id] {
+				v.add(p, "duplicate server peer %s", id)
+			}
+			serverPeers[id] = true
+		}
+	}
+	if c.ServerPeer != "" {
+		serverPeer(path+".server_peer", c.ServerPeer)
+	}
+	for i, s := range c.ServerPeers {
+		serverPeer(fmt.Sprintf("%s.server_peers[%d]", path, i), s)
+	}
+	switch c.Strategy {
+	case "", "failover", "round-robin", "least-latency", "least-connections":
+		if c.Strategy != "" && c.Standalone() {
+			v.add(path+".strategy", "is set without server_peer, server_peers or discover")
+		}
+	default:
+		v.add(path+".strategy", "invalid strategy %q, it must be failover, round-robin, least-latency or least-connections", c.Strategy)
+	}
+	v.nonNegative(path+".health_check_interval", c.HealthCheckInterval)
+	if c.Discover && !discovery {
+		v.add(path+".discover", "is set without discovery.network or discovery.mdns")
+	}
+
+	users := make(map[string]bool)
+	for i, u := range c.Users {
+		p := fmt.Sprintf("%s.users[%d]", path, i)
+		if u.Username == "" || len(u.Username) > 255 {
+			v.add(p+".username", "must be 1 to 255 bytes")
+		}
+		if u.Password == "" || len(u.Password) > 255 {
+			v.add(p+".password", "must be 1 to 255 bytes")
+		}
+		if users[u.Username] {
+			v.add(p+".username", "duplicate user %q", u.Username)
+		}
+		users[u.Username] = true
+	}
+
+	for i, proto := range c.Protocols {
+		switch proto {
+		case "http", "socks5", "socks4":
+		default:
+			v.add(fmt.Sprintf("%s.protocols[%d]", path, i), "invalid protocol %q, it must be http, socks5 or socks4", proto)
+		}
+	}
+}
+
+func (v *validator) acl(path string, c ACLConfig) {
+	for i, s := range c.AllowPeers {
+		v.peerID(fmt.Sprintf("%s.allow_peers[%d]", path, i), s)
+	}
+	for i, s := range c.AllowSubnets {
+		v.cidr(fmt.Sprintf("%s.allow_subnets[%d]", path, i), s)
+	}
+	for i, s := range c.DenyPeers {
+		v.peerID(fmt.Sprintf("%s.deny_peers[%d]", path, i), s)
+	}
+	for i, s := range c.DenySubnets {
+		v.cidr(fmt.Sprintf("%s.deny_subnets[%d]", path, i), s)
+	}
+
+	if c.DefaultPolicy != "" {
+		if _, ok := c.Policies[c.DefaultPolicy]; !ok {
+			v.add(path+".default_policy", "policy %q not found", c.DefaultPolicy)
+		}
+	}
+
+	peers := make(map[string]string)
+	for _, name := range sortedKeys(c.Policies) {
+		p, pc := path+".policies."+name, c.Policies[name]
+		for i, s := range pc.Peers {
+			pp := fmt.Sprintf("%s.peers[%d]", p, i)
+			v.peerID(pp, s)
+			if prior, ok := peers[s]; ok {
+				v.add(pp, "peer is in policy %q already", prior)
+			}
+			peers[s] = name
+		}
+		if pc.Bandwidth < 0 {
+			v.add(p+".bandwidth", "must not be negative")
+		}
+		if pc.Egress != nil {
+			v.egress(p+".egress", *pc.Egress)
+		}
+	}
+}
+
+func (v *validator) egress(path string, c EgressConfig) {
+	for i, s := range c.AllowHosts {
+		v.hostPattern(fmt.Sprintf("%s.allow_hosts[%d]", path, i), s)
+	}
+	for i, s := range c.DenyHosts {
+		v.hostPattern(fmt.Sprintf("%s.deny_hosts[%d]", path, i), s)
+	}
+	for i, s := range c.AllowSubnets {
+		v.cidr(fmt.Sprintf("%s.allow_subnets[%d]", path, i), s)
+	}
+	for i, s := range c.DenySubnets {
+		v.cidr(fmt.Sprintf("%s.deny_subnets[%d]", path, i), s)
+	}
+	for i, s := range c.AllowPorts {
+		if _, _, err := ParsePortRange(s); err != nil {
+			v.add(fmt.Sprintf("%s.allow_ports[%d]", path, i), "%v", err)
+		}
+	}
+}
+
+func (v *validator) hostPattern(field, s string) {
+	pattern := strings.TrimSuffix(strings.TrimSpace(s), ".")
+	if pattern == "" {
+		v.add(field, "empty host pattern")
+		return
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		v.add(field, "invalid host pattern %q: %v", s, err)
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
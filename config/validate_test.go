@@ -0,0 +1,78 @@
+package config
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestSamplesValidate(t *testing.T) {
+	samples, err := filepath.Glob("config_sample_*.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) == 0 {
+		t.Fatal("no config samples")
+	}
+
+	for _, path := range samples {
+		t.Run(path, func(t *testing.T) {
+			cfg, err := LoadConfig(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := cfg.Validate(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestWarningsServerSideOnClient(t *testing.T) {
+	cfg := Default()
+	cfg.Proxy = &ProxyConfig{Addr: "127.0.0.1:1082"}
+	cfg.ServePath = "./www"
+	cfg.Discovery = DiscoveryConfig{Network: "lab", Advertise: true}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	warns := cfg.Warnings()
+	if len(warns) != 2 || warns[0].Path != "serve_path" || warns[1].Path != "discovery.advertise" {
+		t.Errorf("Warnings() = %v, want serve_path and discovery.advertise", warns)
+	}
+
+	cfg.Proxy = nil
+	if warns := cfg.Warnings(); len(warns) != 0 {
+		t.Errorf("Warnings() of a server = %v, want none", warns)
+	}
+}
+
+func TestValidateAdminToken(t *testing.T) {
+	tests := []struct {
+		addr, token string
+		ok          bool
+	}{
+		{"127.0.0.1:1090", "", true},
+		{"[::1]:1090", "", true},
+		{"localhost:1090", "", true},
+		{":1090", "", false},
+		{"0.0.0.0:1090", "", false},
+		{"192.168.1.2:1090", "", false},
+		{"admin.example.com:1090", "", false},
+		{":1090", "my-admin-token", true},
+		{"0.0.0.0:1090", "my-admin-token", true},
+	}
+	for _, tt := range tests {
+		cfg := Default()
+		cfg.Admin = AdminConfig{Addr: tt.addr, Token: tt.token}
+		err := cfg.Validate()
+		if tt.ok && err != nil {
+			t.Errorf("admin %q token %q: Validate() error: %v", tt.addr, tt.token, err)
+		}
+		if !tt.ok {
+			if ve, _ := err.(ValidationError); len(ve) != 1 || ve[0].Path != "admin.token" {
+				t.Errorf("admin %q token %q: Validate() error = %v, want admin.token", tt.addr, tt.token, err)
+			}
+		}
+	}
+}
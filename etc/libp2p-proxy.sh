@@ -10,4 +10,8 @@ export GOLOG_LOG_LEVEL="info"
 export GOLOG_LOG_FMT="json"
 export GOLOG_FILE="$APP_PATH/libp2p-proxy.log"
 
+# every config key can be set by the LIBP2P_PROXY_* environment variables,
+# such as the peer key out of the config file:
+# export LIBP2P_PROXY_PEER_KEY_FILE="$APP_PATH/peer_key"
+
 exec "$APP_PATH"/libp2p-proxy -config "$APP_PATH"/server.json
@@ -3,11 +3,13 @@ package protocol
 import (
 	"fmt"
 	"net"
+	"sync/atomic"
 
 	"github.com/libp2p/go-libp2p/core/connmgr"
 	"github.com/libp2p/go-libp2p/core/control"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
+	relayv2 "github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
 	ma "github.com/multiformats/go-multiaddr"
 	manet "github.com/multiformats/go-multiaddr/net"
 
@@ -15,14 +17,52 @@ import (
 )
 
 var _ connmgr.ConnectionGater = (*ACLFilter)(nil)
+var _ relayv2.ACLFilter = (*ACLFilter)(nil)
 
+// ACLFilter gates the connections with the allow and deny lists, deny takes precedence.
+// The rules can be swapped by Update while it is running.
 type ACLFilter struct {
+	rules  atomic.Pointer[aclRules]
+	denied atomic.Uint64
+}
+
+type aclRules struct {
 	allowPeers   map[peer.ID]struct{}
 	allowSubnets []*net.IPNet
+	denyPeers    map[peer.ID]struct{}
+	denySubnets  []*net.IPNet
+
+	policies      map[string]*Policy
+	peerPolicies  map[peer.ID]*Policy
+	defaultPolicy *Policy
 }
 
 func NewACL(cfg config.ACLConfig) (*ACLFilter, error) {
+	rules, err := newACLRules(cfg)
+	if err != nil {
+		return nil, err
+	}
+
 	acl := &ACLFilter{}
+	acl.rules.Store(rules)
+	return acl, nil
+}
+
+// Update swaps the rules atomically, the new connections and streams are checked
+// with them, the existing connections are kept.
+func (a *ACLFilter) Update(cfg config.ACLConfig) error {
+	rules, err := newACLRules(cfg)
+	if err != nil {
+		return err
+	}
+
+	// the pooled connections were dialed with the old egress policies.
+	a.rules.Swap(rules).closeIdleConnections()
+	return nil
+}
+
+func newACLRules(cfg config.ACLConfig) (*aclRules, error) {
+	acl := &aclRules{}
 
 	if len(cfg.AllowPeers) > 0 {
 		acl.allowPeers = make(map[peer.ID]struct{})
@@ -47,24 +87,139 @@ func NewACL(cfg config.ACLConfig) (*ACLFilter, error) {
 		}
 	}
 
+	if len(cfg.DenyPeers) > 0 {
+		acl.denyPeers = make(map[peer.ID]struct{})
+		for _, s := range cfg.DenyPeers {
+			p, err := peer.Decode(s)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing denied peer ID: %w", err)
+			}
+
+			acl.denyPeers[p] = struct{}{}
+		}
+	}
+
+	if len(cfg.DenySubnets) > 0 {
+		subnets, err := parseSubnets(cfg.DenySubnets)
+		if err != nil {
+			return nil, err
+		}
+		acl.denySubnets = subnets
+	}
+
+	acl.policies = make(map[string]*Policy, len(cfg.Policies))
+	acl.peerPolicies = make(map[peer.ID]*Policy)
+	for name, pc := range cfg.Policies {
+		pl, err := newPolicy(name, pc)
+		if err != nil {
+			return nil, err
+		}
+		acl.policies[name] = pl
+
+		for _, s := range pc.Peers {
+			p, err := peer.Decode(s)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing peer ID of policy %q: %w", name, err)
+			}
+			if prior, ok := acl.peerPolicies[p]; ok {
+				return nil, fmt.Errorf("peer %s is in both policy %q and %q", p, prior.Name, name)
+			}
+			acl.peerPolicies[p] = pl
+		}
+	}
+
+	if cfg.DefaultPolicy != "" {
+		pl, ok := acl.policies[cfg.DefaultPolicy]
+		if !ok {
+			return nil, fmt.Errorf("default policy %q not found", cfg.DefaultPolicy)
+		}
+		acl.defaultPolicy = pl
+	}
+
 	return acl, nil
 }
 
+// Policy returns the policy of the peer, or the default policy,
+// nil means the peer has no policy and is allowed everything.
+func (a *ACLFilter) Policy(p peer.ID) *Policy {
+	r := a.rules.Load()
+	if pl, ok := r.peerPolicies[p]; ok {
+		return pl
+	}
+	return r.defaultPolicy
+}
+
+// AllowConn checks the existing connection with the current rules.
+func (a *ACLFilter) AllowConn(c network.Conn) bool {
+	if c.Stat().Direction == network.DirOutbound {
+		return !a.denyPeer(c.RemotePeer(), "conn") && !a.denyAddr(c.RemoteMultiaddr(), "conn")
+	}
+	return a.Allow(c.RemotePeer(), c.RemoteMultiaddr())
+}
+
+func (r *aclRules) closeIdleConnections() {
+	for _, pl := range r.policies {
+		if pl.transport != nil {
+			pl.transport.CloseIdleConnections()
+		}
+	}
+}
+
+// Denied returns the number of the connections and dials denied by the deny lists.
+func (a *ACLFilter) Denied() uint64 {
+	return a.denied.Load()
+}
+
+// denyPeer reports whether the peer is in the deny list, the denial is logged and counted.
+func (a *ACLFilter) denyPeer(p peer.ID, hook string) bool {
+	if _, ok := a.rules.Load().denyPeers[p]; !ok {
+		return false
+	}
+
+	n := a.denied.Add(1)
+	Log.Warnf("acl denied peer %s on %s, total denied: %d", p, hook, n)
+	return true
+}
+
+// denyAddr reports whether the IP of addr is in the denied subnets, the denial is logged and counted.
+func (a *ACLFilter) denyAddr(addr ma.Multiaddr, hook string) bool {
+	subnets := a.rules.Load().denySubnets
+	if len(subnets) == 0 || addr == nil {
+		return false
+	}
+	ip, err := manet.ToIP(addr)
+	if err != nil || !containsSubnet(subnets, ip) {
+		return false
+	}
+
+	n := a.denied.Add(1)
+	Log.Warnf("acl denied address %s on %s, total denied: %d", addr, hook, n)
+	return true
+}
+
 func (a *ACLFilter) Allow(p peer.ID, addr ma.Multiaddr) bool {
-	if len(a.allowPeers) > 0 {
-		_, ok := a.allowPeers[p]
+	if a.denyPeer(p, "allow") || a.denyAddr(addr, "allow") {
+		return false
+	}
+
+	r := a.rules.Load()
+	if len(r.allowPeers) > 0 {
+		_, ok := r.allowPeers[p]
 		if !ok {
 			return false
 		}
 	}
 
-	if len(a.allowSubnets) > 0 {
+	if len(r.allowSubnets) > 0 {
+		if addr == nil {
+			return false
+		}
 		ip, err := manet.ToIP(addr)
 		if err != nil {
 			return false
 		}
 
-		for _, ipnet := range a.allowSubnets {
+		for _, ipnet := range r.allowSubnets {
 			if ipnet.Contains(ip) {
 				return true
 			}
@@ -75,23 +230,39 @@ func (a *ACLFilter) Allow(p peer.ID, addr ma.Multiaddr) bool {
 	return true
 }
 
+// AllowReserve restricts the relay reservations to the allowed peers.
+func (a *ACLFilter) AllowReserve(p peer.ID, addr ma.Multiaddr) bool {
+	return a.Allow(p, addr)
+}
+
+// AllowConnect restricts the relayed connections to the allowed source peers,
+// the destination is allowed by its reservation.
+func (a *ACLFilter) AllowConnect(src peer.ID, srcAddr ma.Multiaddr, dest peer.ID) bool {
+	return !a.denyPeer(dest, "relay connect") && a.Allow(src, srcAddr)
+}
+
 func (a *ACLFilter) InterceptPeerDial(p peer.ID) (allow bool) {
-	return true
+	return !a.denyPeer(p, "peer dial")
 }
 
-func (a *ACLFilter) InterceptAddrDial(peer.ID, ma.Multiaddr) (allow bool) {
-	return true
+func (a *ACLFilter) InterceptAddrDial(p peer.ID, addr ma.Multiaddr) (allow bool) {
+	return !a.denyPeer(p, "addr dial") && !a.denyAddr(addr, "addr dial")
 }
 
 func (a *ACLFilter) InterceptAccept(cm network.ConnMultiaddrs) (allow bool) {
-	if len(a.allowSubnets) > 0 {
+	if a.denyAddr(cm.RemoteMultiaddr(), "accept") {
+		return false
+	}
+
+	r := a.rules.Load()
+	if len(r.allowSubnets) > 0 {
 		addr := cm.RemoteMultiaddr()
 		ip, err := manet.ToIP(addr)
 		if err != nil {
 			return false
 		}
 
-		for _, ipnet := range a.allowSubnets {
+		for _, ipnet := range r.allowSubnets {
 			if ipnet.Contains(ip) {
 				return true
 			}
@@ -102,11 +273,15 @@ func (a *ACLFilter) InterceptAccept(cm network.ConnMultiaddrs) (allow bool) {
 }
 
 func (a *ACLFilter) InterceptSecured(di network.Direction, p peer.ID, cm network.ConnMultiaddrs) (allow bool) {
+	if a.denyPeer(p, "secured") {
+		return false
+	}
 	if di == network.DirOutbound {
 		return true
 	}
-	if len(a.allowPeers) > 0 {
-		_, ok := a.allowPeers[p]
+	r := a.rules.Load()
+	if len(r.allowPeers) > 0 {
+		_, ok := r.allowPeers[p]
 		if !ok {
 			return false
 		}
@@ -0,0 +1,204 @@
+package protocol
+
+import (
+	"context"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/test"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	ma "github.com/multiformats/go-multiaddr"
+
+	"github.com/p2pdao/libp2p-proxy/config"
+)
+
+func TestACLAllow(t *testing.T) {
+	a, b, c := test.RandPeerIDFatal(t), test.RandPeerIDFatal(t), test.RandPeerIDFatal(t)
+	inside := ma.StringCast("/ip4/10.0.0.1/tcp/4001")
+	denied := ma.StringCast("/ip4/10.0.1.1/tcp/4001")
+	outside := ma.StringCast("/ip4/192.168.0.1/tcp/4001")
+
+	tests := []struct {
+		name string
+		cfg  config.ACLConfig
+		peer peer.ID
+		addr ma.Multiaddr
+		want bool
+	}{
+		{name: "no rules", peer: a, addr: outside, want: true},
+		{name: "allowed peer", cfg: config.ACLConfig{AllowPeers: []string{a.String()}}, peer: a, addr: outside, want: true},
+		{name: "not allowed peer", cfg: config.ACLConfig{AllowPeers: []string{a.String()}}, peer: b, addr: outside},
+		{name: "denied peer", cfg: config.ACLConfig{DenyPeers: []string{a.String()}}, peer: a, addr: outside},
+		{name: "not denied peer", cfg: config.ACLConfig{DenyPeers: []string{a.String()}}, peer: b, addr: outside, want: true},
+		{
+			name: "deny peer beats allow peer",
+			cfg:  config.ACLConfig{AllowPeers: []string{a.String(), b.String()}, DenyPeers: []string{a.String()}},
+			peer: a, addr: outside,
+		},
+		{name: "allowed subnet", cfg: config.ACLConfig{AllowSubnets: []string{"10.0.0.0/8"}}, peer: a, addr: inside, want: true},
+		{name: "not allowed subnet", cfg: config.ACLConfig{AllowSubnets: []string{"10.0.0.0/8"}}, peer: a, addr: outside},
+		{name: "allowed subnet of no ip", cfg: config.ACLConfig{AllowSubnets: []string{"10.0.0.0/8"}}, peer: a},
+		{name: "denied subnet", cfg: config.ACLConfig{DenySubnets: []string{"10.0.1.0/24"}}, peer: a, addr: denied},
+		{
+			name: "deny subnet beats allow subnet",
+			cfg:  config.ACLConfig{AllowSubnets: []string{"10.0.0.0/8"}, DenySubnets: []string{"10.0.1.0/24"}},
+			peer: a, addr: denied,
+		},
+		{
+			name: "deny subnet beats allow peer",
+			cfg:  config.ACLConfig{AllowPeers: []string{a.String()}, DenySubnets: []string{"10.0.1.0/24"}},
+			peer: a, addr: denied,
+		},
+		{
+			name: "deny peer beats allow subnet",
+			cfg:  config.ACLConfig{AllowSubnets: []string{"10.0.0.0/8"}, DenyPeers: []string{c.String()}},
+			peer: c, addr: inside,
+		},
+		{
+			name: "allow peer and subnet",
+			cfg:  config.ACLConfig{AllowPeers: []string{a.String()}, AllowSubnets: []string{"10.0.0.0/8"}},
+			peer: a, addr: outside,
+		},
+	}
+	for _, tt := range tests {
+		acl, err := NewACL(tt.cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := acl.Allow(tt.peer, tt.addr); got != tt.want {
+			t.Errorf("%s: Allow() = %v, want %v", tt.name, got, tt.want)
+		}
+		if got := acl.AllowReserve(tt.peer, tt.addr); got != tt.want {
+			t.Errorf("%s: AllowReserve() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestACLAllowConnect(t *testing.T) {
+	src, dest, other := test.RandPeerIDFatal(t), test.RandPeerIDFatal(t), test.RandPeerIDFatal(t)
+	addr := ma.StringCast("/ip4/10.0.0.1/tcp/4001")
+
+	tests := []struct {
+		name string
+		cfg  config.ACLConfig
+		want bool
+	}{
+		{name: "no rules", want: true},
+		{name: "denied source", cfg: config.ACLConfig{DenyPeers: []string{src.String()}}},
+		{name: "denied destination", cfg: config.ACLConfig{DenyPeers: []string{dest.String()}}},
+		{name: "denied source subnet", cfg: config.ACLConfig{DenySubnets: []string{"10.0.0.0/8"}}},
+		{name: "allowed source", cfg: config.ACLConfig{AllowPeers: []string{src.String()}}, want: true},
+		// the destination is allowed by its reservation.
+		{name: "allowed other source", cfg: config.ACLConfig{AllowPeers: []string{other.String(), dest.String()}}},
+		{
+			name: "deny beats allow of the destination",
+			cfg:  config.ACLConfig{AllowPeers: []string{src.String()}, DenyPeers: []string{dest.String()}},
+		},
+	}
+	for _, tt := range tests {
+		acl, err := NewACL(tt.cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := acl.AllowConnect(src, addr, dest); got != tt.want {
+			t.Errorf("%s: AllowConnect() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestACLDenied(t *testing.T) {
+	a := test.RandPeerIDFatal(t)
+	acl, err := NewACL(config.ACLConfig{DenyPeers: []string{a.String()}, DenySubnets: []string{"10.0.0.0/8"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acl.InterceptPeerDial(a) {
+		t.Error("InterceptPeerDial() of the denied peer is allowed")
+	}
+	if acl.InterceptAddrDial(test.RandPeerIDFatal(t), ma.StringCast("/ip4/10.0.0.1/tcp/4001")) {
+		t.Error("InterceptAddrDial() of the denied subnet is allowed")
+	}
+	if acl.InterceptSecured(network.DirOutbound, a, nil) {
+		t.Error("InterceptSecured() of the denied peer is allowed")
+	}
+	if n := acl.Denied(); n != 3 {
+		t.Errorf("Denied() = %d, want 3", n)
+	}
+}
+
+func TestACLUpdate(t *testing.T) {
+	a := test.RandPeerIDFatal(t)
+	acl, err := NewACL(config.ACLConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := acl.Update(config.ACLConfig{DenyPeers: []string{a.String()}}); err != nil {
+		t.Fatal(err)
+	}
+	if acl.Allow(a, nil) {
+		t.Error("the denied peer is allowed after Update")
+	}
+
+	// a bad config keeps the rules.
+	if err := acl.Update(config.ACLConfig{DenyPeers: []string{"not a peer"}}); err == nil {
+		t.Error("Update() of a bad peer ID is ok")
+	}
+	if err := acl.Update(config.ACLConfig{DefaultPolicy: "missing"}); err == nil {
+		t.Error("Update() of a missing default policy is ok")
+	}
+	if acl.Allow(a, nil) {
+		t.Error("the rules are changed by a bad config")
+	}
+}
+
+func TestCloseDisallowed(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn, err := mocknet.FullMeshLinked(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mn.Close()
+	hosts := mn.Hosts()
+	h, inbound, outbound, denied := hosts[0], hosts[1], hosts[2], hosts[3]
+	for _, c := range [][2]peer.ID{{inbound.ID(), h.ID()}, {h.ID(), outbound.ID()}, {denied.ID(), h.ID()}} {
+		if _, err := mn.ConnectPeers(c[0], c[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	acl, err := NewACL(config.ACLConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewProxyService(ctx, h, "p2p.to", WithACL(acl))
+	if n := p.CloseDisallowed(); n != 0 {
+		t.Errorf("CloseDisallowed() of no rules = %d", n)
+	}
+
+	// the allow list gates the inbound connections only, the deny list gates both.
+	if err := acl.Update(config.ACLConfig{
+		AllowPeers: []string{denied.ID().String()},
+		DenyPeers:  []string{denied.ID().String()},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if n := p.CloseDisallowed(); n != 2 {
+		t.Errorf("CloseDisallowed() = %d, want 2", n)
+	}
+	for _, tt := range []struct {
+		host   peer.ID
+		closed bool
+	}{
+		{inbound.ID(), true},
+		{outbound.ID(), false},
+		{denied.ID(), true},
+	} {
+		if closed := h.Network().Connectedness(tt.host) != network.Connected; closed != tt.closed {
+			t.Errorf("the connection of %s closed = %v, want %v", tt.host, closed, tt.closed)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package protocol
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/p2pdao/libp2p-proxy/config"
+)
+
+type credential struct {
+	secret []byte
+	bcrypt bool
+}
+
+// Credentials is the user store of the proxy listener,
+// the password can be plain text or a bcrypt hash.
+type Credentials struct {
+	users map[string]credential
+}
+
+// NewCredentials returns nil if no user is configured, that means no authentication.
+func NewCredentials(users []config.UserConfig) (*Credentials, error) {
+	if len(users) == 0 {
+		return nil, nil
+	}
+
+	c := &Credentials{users: make(map[string]credential, len(users))}
+	for _, u := range users {
+		// RFC 1929 limits username and password to 255 bytes
+		if u.Username == "" || len(u.Username) > 255 {
+			return nil, fmt.Errorf("invalid proxy username: %q", u.Username)
+		}
+		if u.Password == "" || len(u.Password) > 255 {
+			return nil, fmt.Errorf("invalid password for proxy user %q", u.Username)
+		}
+		if _, ok := c.users[u.Username]; ok {
+			return nil, fmt.Errorf("duplicate proxy user %q", u.Username)
+		}
+
+		secret := []byte(u.Password)
+		_, err := bcrypt.Cost(secret)
+		c.users[u.Username] = credential{secret: secret, bcrypt: err == nil}
+	}
+	return c, nil
+}
+
+func (c *Credentials) Verify(username, password string) bool {
+	cred, ok := c.users[username]
+	if !ok {
+		return false
+	}
+
+	if cred.bcrypt {
+		return bcrypt.CompareHashAndPassword(cred.secret, []byte(password)) == nil
+	}
+	return subtle.ConstantTimeCompare(cred.secret, []byte(password)) == 1
+}
+
+// httpAuthenticate checks the Basic credentials in the Proxy-Authorization header,
+// a 407 challenge is written to the client if it fails.
+func (p *ProxyService) httpAuthenticate(bs *BufReaderStream, req *http.Request) (string, bool) {
+	user, ok := p.httpVerify(bs, req)
+	if !ok {
+		writeHTTPAuthRequired(bs)
+	}
+	return user, ok
+}
+
+// httpVerify checks the Basic credentials in the Proxy-Authorization header.
+func (p *ProxyService) httpVerify(bs *BufReaderStream, req *http.Request) (string, bool) {
+	creds := bs.credentials()
+	if creds == nil {
+		return "", true
+	}
+
+	user, password, ok := proxyBasicAuth(req)
+	if ok && creds.Verify(user, password) {
+		return user, true
+	}
+
+	if ok {
+		Log.Warnf("http proxy authentication failed, user: %q, remote: %s", user, bs.RemoteAddr())
+	}
+	return user, false
+}
+
+func proxyBasicAuth(req *http.Request) (string, string, bool) {
+	r := &http.Request{Header: http.Header{"Authorization": req.Header.Values("Proxy-Authorization")}}
+	return r.BasicAuth()
+}
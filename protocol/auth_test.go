@@ -0,0 +1,87 @@
+package protocol
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/p2pdao/libp2p-proxy/config"
+)
+
+func TestCredentialsVerify(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("bob-password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds, err := NewCredentials([]config.UserConfig{
+		{Username: "alice", Password: "alice-password"},
+		{Username: "bob", Password: string(hash)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		user, password string
+		want           bool
+	}{
+		{"alice", "alice-password", true},
+		{"alice", "alice-password ", false},
+		{"alice", "", false},
+		{"alice", "bob-password", false},
+		{"bob", "bob-password", true},
+		{"bob", string(hash), false}, // the hash isn't the password
+		{"bob", "alice-password", false},
+		{"carol", "alice-password", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		if got := creds.Verify(tt.user, tt.password); got != tt.want {
+			t.Errorf("Verify(%q, %q) = %v, want %v", tt.user, tt.password, got, tt.want)
+		}
+	}
+}
+
+func TestNewCredentials(t *testing.T) {
+	if c, err := NewCredentials(nil); c != nil || err != nil {
+		t.Errorf("NewCredentials(nil) = %v, %v, want no authentication", c, err)
+	}
+
+	long := strings.Repeat("x", 256)
+	tests := []struct {
+		name  string
+		users []config.UserConfig
+		err   string
+	}{
+		{"empty username", []config.UserConfig{{Password: "pw"}}, "invalid proxy username"},
+		{"long username", []config.UserConfig{{Username: long, Password: "pw"}}, "invalid proxy username"},
+		{"empty password", []config.UserConfig{{Username: "alice"}}, "invalid password"},
+		{"long password", []config.UserConfig{{Username: "alice", Password: long}}, "invalid password"},
+		{"duplicate", []config.UserConfig{{Username: "alice", Password: "a"}, {Username: "alice", Password: "b"}}, "duplicate"},
+	}
+	for _, tt := range tests {
+		if _, err := NewCredentials(tt.users); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: NewCredentials() error = %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestProxyBasicAuth(t *testing.T) {
+	req := &http.Request{Header: http.Header{}}
+	if _, _, ok := proxyBasicAuth(req); ok {
+		t.Error("proxyBasicAuth() of no header is ok")
+	}
+
+	// Authorization is for the origin server.
+	req.Header.Set("Authorization", basicAuth("alice", "pw"))
+	if _, _, ok := proxyBasicAuth(req); ok {
+		t.Error("proxyBasicAuth() of Authorization is ok")
+	}
+
+	req.Header.Set("Proxy-Authorization", basicAuth("bob", "p:w"))
+	if user, password, ok := proxyBasicAuth(req); !ok || user != "bob" || password != "p:w" {
+		t.Errorf("proxyBasicAuth() = %q, %q, %v", user, password, ok)
+	}
+}
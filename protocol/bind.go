@@ -0,0 +1,139 @@
+package protocol
+
+import (
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/txthinking/socks5"
+)
+
+const bindAcceptTimeout = 60 * time.Second
+
+// socks5Bind listens on the server side for one inbound connection from the
+// application server, the first reply carries the bound address and the second
+// reply carries the address of the accepted connection.
+func (p *ProxyService) socks5Bind(bs *BufReaderStream, r *socks5.Request, user string) error {
+	// DST.ADDR is the application server that will connect to the bound address,
+	// it is checked by the egress policy, no other host can take the connection.
+	expected, err := p.bindPeerIPs(bs, r.Address())
+	if err != nil {
+		rep := socks5.RepHostUnreachable
+		if isEgressDenied(err) {
+			rep = socks5.RepNotAllowed
+		}
+		if e := replyErr(r, bs, rep); e != nil {
+			return e
+		}
+		return err
+	}
+
+	ip, err := bindLocalIP(expected[0])
+	if err != nil {
+		if e := replyErr(r, bs, socks5.RepNetworkUnreachable); e != nil {
+			return e
+		}
+		return err
+	}
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: ip})
+	if err != nil {
+		if e := replyErr(r, bs, socks5.RepServerFailure); e != nil {
+			return e
+		}
+		return err
+	}
+	defer ln.Close()
+
+	port := ln.Addr().(*net.TCPAddr).Port
+	a, addr, bport, err := socks5.ParseAddress(net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+	if err != nil {
+		if e := replyErr(r, bs, socks5.RepServerFailure); e != nil {
+			return e
+		}
+		return err
+	}
+
+	reply := socks5.NewReply(socks5.RepSuccess, a, addr, bport)
+	if _, err := reply.WriteTo(bs); err != nil {
+		return err
+	}
+	if user != "" {
+		Log.Debugf("socks5 user %q bind on %s for %s", user, ln.Addr(), r.Address())
+	}
+
+	ln.SetDeadline(time.Now().Add(bindAcceptTimeout))
+	var conn *net.TCPConn
+	for {
+		conn, err = ln.AcceptTCP()
+		if err != nil {
+			if e := replyErr(r, bs, socks5.RepTTLExpired); e != nil {
+				return e
+			}
+			return err
+		}
+
+		if containsIP(expected, conn.RemoteAddr().(*net.TCPAddr).IP) {
+			break
+		}
+		Log.Warnf("socks5 bind rejects connection from %s, expected %s", conn.RemoteAddr(), r.Address())
+		conn.Close()
+	}
+
+	defer conn.Close()
+	ln.Close()
+	a, addr, bport, err = socks5.ParseAddress(conn.RemoteAddr().String())
+	if err != nil {
+		if e := replyErr(r, bs, socks5.RepServerFailure); e != nil {
+			return e
+		}
+		return err
+	}
+
+	reply = socks5.NewReply(socks5.RepSuccess, a, addr, bport)
+	if _, err := reply.WriteTo(bs); err != nil {
+		return err
+	}
+
+	return tunneling(conn, bs)
+}
+
+// bindPeerIPs returns the IPs of the application server allowed by the egress
+// policy of the peer of bs, the unspecified address is not allowed.
+func (p *ProxyService) bindPeerIPs(bs *BufReaderStream, address string) ([]net.IP, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		return nil, &EgressError{Addr: address, Reason: "unspecified address"}
+	}
+
+	if e := p.egressOf(p.policyOf(bs)); e != nil {
+		return e.resolveIPs(p.ctx, address, host)
+	}
+	ips, err := net.DefaultResolver.LookupIP(p.ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	return ips, nil
+}
+
+// bindLocalIP returns the local IP that routes to the application server,
+// no packet is sent by dialing UDP.
+func bindLocalIP(ip net.IP) (net.IP, error) {
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: ip, Port: 9})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, v := range ips {
+		if v.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
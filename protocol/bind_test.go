@@ -0,0 +1,120 @@
+package protocol
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/txthinking/socks5"
+
+	"github.com/p2pdao/libp2p-proxy/config"
+)
+
+// socks5BindRequest sends a BIND request to the proxy, it returns the client
+// connection and the first reply.
+func socks5BindRequest(t *testing.T, p *ProxyService, dst string) (net.Conn, *socks5.Reply) {
+	conn, s := net.Pipe()
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		defer s.Close()
+		p.socks5Handler(NewBufReaderStream(s))
+	}()
+
+	if _, err := socks5.NewNegotiationRequest([]byte{socks5.MethodNone}).WriteTo(conn); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := socks5.NewNegotiationReplyFrom(conn); err != nil {
+		t.Fatal(err)
+	}
+	a, addr, port, err := socks5.ParseAddress(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a == socks5.ATYPDomain {
+		// NewRequest adds the length prefix again.
+		addr = addr[1:]
+	}
+	if _, err := socks5.NewRequest(socks5.CmdBind, a, addr, port).WriteTo(conn); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := socks5.NewReplyFrom(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, reply
+}
+
+func TestSocks5Bind(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	p := &ProxyService{ctx: ctx}
+	egress, err := NewEgressPolicy(config.EgressConfig{AllowPrivate: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.egress.Store(egress)
+
+	conn, reply := socks5BindRequest(t, p, "127.0.0.1:0")
+	if reply.Rep != socks5.RepSuccess {
+		t.Fatalf("BIND reply = %d", reply.Rep)
+	}
+	bound, err := net.ResolveTCPAddr("tcp", reply.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bound.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("bound address = %s, want the loopback routing to the application server", bound)
+	}
+
+	app, err := net.DialTCP("tcp", nil, bound)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Close()
+	if reply, err = socks5.NewReplyFrom(conn); err != nil || reply.Rep != socks5.RepSuccess {
+		t.Fatalf("second BIND reply = %v, %v", reply, err)
+	}
+	if reply.Address() != app.LocalAddr().String() {
+		t.Errorf("second BIND reply address = %s, want %s", reply.Address(), app.LocalAddr())
+	}
+
+	if _, err := app.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 4)
+	if _, err := conn.Read(b); err != nil || string(b) != "ping" {
+		t.Errorf("tunneled %q, %v", b, err)
+	}
+}
+
+func TestSocks5BindDenied(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tests := []struct {
+		name string
+		cfg  config.EgressConfig
+		dst  string
+	}{
+		{name: "unspecified", cfg: config.EgressConfig{AllowPrivate: true}, dst: "0.0.0.0:0"},
+		{name: "unspecified ipv6", cfg: config.EgressConfig{AllowPrivate: true}, dst: "[::]:0"},
+		{name: "private by default", dst: "127.0.0.1:0"},
+		{name: "denied subnet", cfg: config.EgressConfig{DenySubnets: []string{"203.0.113.0/24"}}, dst: "203.0.113.1:0"},
+		{name: "denied host", cfg: config.EgressConfig{DenyHosts: []string{"app.example.com"}}, dst: "app.example.com:0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &ProxyService{ctx: ctx}
+			egress, err := NewEgressPolicy(tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.egress.Store(egress)
+
+			if _, reply := socks5BindRequest(t, p, tt.dst); reply.Rep != socks5.RepNotAllowed {
+				t.Errorf("BIND %s reply = %d, want %d", tt.dst, reply.Rep, socks5.RepNotAllowed)
+			}
+		})
+	}
+}
@@ -3,7 +3,12 @@ package protocol
 import (
 	"bufio"
 	"io"
+	"net"
 	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	manet "github.com/multiformats/go-multiaddr/net"
 )
 
 var _ Stream = (*BufReaderStream)(nil)
@@ -30,9 +35,19 @@ type reseter interface {
 	Reset() error
 }
 
+type remoteAddrer interface {
+	RemoteAddr() net.Addr
+}
+
+type connStream interface {
+	Conn() network.Conn
+}
+
 type BufReaderStream struct {
 	s      Stream
 	Reader *bufio.Reader
+
+	listener *Listener // the local proxy listener of a net.Conn
 }
 
 func (bs *BufReaderStream) Read(p []byte) (int, error) {
@@ -68,6 +83,49 @@ func (bs *BufReaderStream) CloseRead() error {
 	return bs.s.Close()
 }
 
+// RemoteAddr returns the remote peer of a libp2p stream,
+// or the remote address of a net.Conn.
+func (bs *BufReaderStream) RemoteAddr() string {
+	switch s := bs.s.(type) {
+	case connStream:
+		return s.Conn().RemotePeer().String()
+	case remoteAddrer:
+		return s.RemoteAddr().String()
+	}
+	return ""
+}
+
+// RemotePeer returns the remote peer ID if it is a libp2p stream.
+func (bs *BufReaderStream) RemotePeer() (peer.ID, bool) {
+	if s, ok := bs.s.(connStream); ok {
+		return s.Conn().RemotePeer(), true
+	}
+	return "", false
+}
+
+// RemoteIP returns the IP of the remote peer connection or net.Conn, nil if unknown.
+func (bs *BufReaderStream) RemoteIP() net.IP {
+	switch s := bs.s.(type) {
+	case connStream:
+		ip, _ := manet.ToIP(s.Conn().RemoteMultiaddr())
+		return ip
+	case remoteAddrer:
+		if addr, ok := s.RemoteAddr().(*net.TCPAddr); ok {
+			return addr.IP
+		}
+	}
+	return nil
+}
+
+// credentials returns the credentials of the local proxy listener, nil for
+// libp2p streams and the listeners without authentication.
+func (bs *BufReaderStream) credentials() *Credentials {
+	if bs.listener == nil {
+		return nil
+	}
+	return bs.listener.creds.Load()
+}
+
 func (bs *BufReaderStream) SetDeadline(t time.Time) error {
 	return bs.s.SetDeadline(t)
 }
@@ -0,0 +1,87 @@
+package protocol
+
+import (
+	"context"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/discovery"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+)
+
+const (
+	advertiseRetry   = 30 * time.Second
+	discoverTimeout  = time.Minute
+	discoverRetry    = 30 * time.Second // while no server peer is healthy
+	discoverInterval = 10 * time.Minute
+)
+
+// DiscoveryNamespace returns the namespace of the proxy server peers of a network,
+// the DHT provider records are stored under the CID of it.
+func DiscoveryNamespace(network string) string {
+	return ServiceName + "/" + network
+}
+
+// Advertise advertises the host as a proxy server peer of the network until ctx
+// is done, the advertisement is renewed before it expires.
+func Advertise(ctx context.Context, a discovery.Advertiser, network string) {
+	ns := DiscoveryNamespace(network)
+	for {
+		wait := advertiseRetry
+		ttl, err := a.Advertise(ctx, ns)
+		if err != nil {
+			Log.Warnf("advertising %s error: %v", ns, err)
+		} else {
+			Log.Infof("advertised %s, TTL: %s", ns, ttl)
+			wait = 7 * ttl / 8
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Discover finds the proxy server peers of the network until ctx is done, the
+// peers allowed by allow are added to the group. A nil allow allows all.
+func (g *PeerGroup) Discover(ctx context.Context, d discovery.Discoverer, network string, allow func(peer.ID) bool) {
+	ns := DiscoveryNamespace(network)
+	for {
+		g.discover(ctx, d, ns, allow)
+
+		wait := discoverInterval
+		if !g.Connected() {
+			wait = discoverRetry
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (g *PeerGroup) discover(ctx context.Context, d discovery.Discoverer, ns string, allow func(peer.ID) bool) {
+	ctx, cancel := context.WithTimeout(ctx, discoverTimeout)
+	defer cancel()
+
+	ch, err := d.FindPeers(ctx, ns)
+	if err != nil {
+		Log.Warnf("discovering %s error: %v", ns, err)
+		return
+	}
+	for pi := range ch {
+		if pi.ID == g.h.ID() {
+			continue
+		}
+		if allow != nil && !allow(pi.ID) {
+			Log.Debugf("discovered peer %s of %s is not allowed", pi.ID, ns)
+			continue
+		}
+		if g.Add(pi, peerstore.AddressTTL) {
+			Log.Infof("discovered server peer %s of %s", pi.ID, ns)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package protocol
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/peer"
+	drouting "github.com/libp2p/go-libp2p/p2p/discovery/routing"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+)
+
+// newDHTNetwork returns the DHTs of n connected hosts in memory.
+func newDHTNetwork(ctx context.Context, t *testing.T, n int) []*dht.IpfsDHT {
+	mn, err := mocknet.FullMeshLinked(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { mn.Close() })
+
+	dhts := make([]*dht.IpfsDHT, n)
+	for i, h := range mn.Hosts() {
+		if dhts[i], err = dht.New(ctx, h, dht.Mode(dht.ModeServer)); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { dhts[i].Close() })
+	}
+	// the hosts are connected after the DHT protocols are registered,
+	// so they are identified as DHT servers.
+	if err := mn.ConnectAllButSelf(); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range dhts {
+		waitFor(t, func() bool { return d.RoutingTable().Size() == n-1 })
+	}
+	return dhts
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestDiscover(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := newDHTNetwork(ctx, t, 4)
+	client, allowed, denied := dhts[0], dhts[1], dhts[2]
+	go Advertise(ctx, drouting.NewRoutingDiscovery(allowed), "lab")
+	go Advertise(ctx, drouting.NewRoutingDiscovery(denied), "lab")
+	// a peer of another network
+	go Advertise(ctx, drouting.NewRoutingDiscovery(dhts[3]), "other")
+
+	g, err := NewPeerGroup(client.Host(), client, nil, StrategyFailover)
+	if err != nil {
+		t.Fatal(err)
+	}
+	allow := func(id peer.ID) bool { return id != denied.PeerID() }
+	d := drouting.NewRoutingDiscovery(client)
+	waitFor(t, func() bool {
+		g.discover(ctx, d, DiscoveryNamespace("lab"), allow)
+		return g.has(allowed.PeerID())
+	})
+
+	if peers := g.Peers(); len(peers) != 1 {
+		t.Errorf("Peers() = %v, want only %s", peers, allowed.PeerID())
+	}
+	if g.has(denied.PeerID()) {
+		t.Errorf("the peer %s not allowed is added", denied.PeerID())
+	}
+	if g.has(dhts[3].PeerID()) {
+		t.Errorf("the peer %s of another network is added", dhts[3].PeerID())
+	}
+}
@@ -0,0 +1,306 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/p2pdao/libp2p-proxy/config"
+)
+
+// specialSubnets are the non-public ranges that net.IP methods don't report.
+var specialSubnets = mustParseCIDRs(
+	"0.0.0.0/8",     // "this" network
+	"100.64.0.0/10", // carrier-grade NAT
+	"192.0.0.0/24",  // IETF protocol assignments
+	"198.18.0.0/15", // benchmarking
+	"240.0.0.0/4",   // reserved
+)
+
+// EgressError is returned when the destination is not allowed by the EgressPolicy.
+type EgressError struct {
+	Addr   string
+	Reason string
+}
+
+func (e *EgressError) Error() string {
+	return fmt.Sprintf("destination %s is not allowed: %s", e.Addr, e.Reason)
+}
+
+type portRange struct {
+	from, to int
+}
+
+// EgressPolicy decides which destinations the proxy dials for its clients.
+// The host rules are checked on the requested name, the subnet rules on every
+// resolved IP, and only the allowed IPs are dialed, so DNS rebinding can't
+// reach a denied address. Deny rules take precedence, a non-empty allow list
+// restricts the destinations to it.
+type EgressPolicy struct {
+	allowHosts   []string
+	denyHosts    []string
+	allowSubnets []*net.IPNet
+	denySubnets  []*net.IPNet
+	allowPorts   []portRange
+	allowPrivate bool
+
+	resolver *net.Resolver
+	dialer   *net.Dialer
+}
+
+func NewEgressPolicy(cfg config.EgressConfig) (*EgressPolicy, error) {
+	e := &EgressPolicy{
+		allowPrivate: cfg.AllowPrivate,
+		resolver:     net.DefaultResolver,
+		dialer: &net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		},
+	}
+
+	var err error
+	if e.allowHosts, err = parseHostPatterns(cfg.AllowHosts); err != nil {
+		return nil, err
+	}
+	if e.denyHosts, err = parseHostPatterns(cfg.DenyHosts); err != nil {
+		return nil, err
+	}
+	if e.allowSubnets, err = parseSubnets(cfg.AllowSubnets); err != nil {
+		return nil, err
+	}
+	if e.denySubnets, err = parseSubnets(cfg.DenySubnets); err != nil {
+		return nil, err
+	}
+
+	for _, s := range cfg.AllowPorts {
+		from, to, err := config.ParsePortRange(s)
+		if err != nil {
+			return nil, err
+		}
+		e.allowPorts = append(e.allowPorts, portRange{from, to})
+	}
+	return e, nil
+}
+
+// Resolve checks the destination address, and returns the allowed addresses
+// of its resolved IPs.
+func (e *EgressPolicy) Resolve(ctx context.Context, address string) ([]string, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		port, err = e.resolver.LookupPort(ctx, "tcp", portStr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !e.allowPort(port) {
+		return nil, &EgressError{Addr: address, Reason: "port"}
+	}
+
+	ips, err := e.resolveIPs(ctx, address, host)
+	if err != nil {
+		return nil, err
+	}
+	allowed := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		allowed = append(allowed, net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+	}
+	return allowed, nil
+}
+
+// resolveIPs checks the host of the destination address, and returns its
+// resolved IPs allowed by the subnet rules.
+func (e *EgressPolicy) resolveIPs(ctx context.Context, address, host string) ([]net.IP, error) {
+	name := strings.TrimSuffix(strings.ToLower(host), ".")
+	if matchHost(e.denyHosts, name) {
+		return nil, &EgressError{Addr: address, Reason: "host denied"}
+	}
+	if len(e.allowHosts) > 0 && !matchHost(e.allowHosts, name) {
+		return nil, &EgressError{Addr: address, Reason: "host not in allow list"}
+	}
+
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		addrs, err := e.resolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range addrs {
+			ips = append(ips, a.IP)
+		}
+	}
+
+	allowed := make([]net.IP, 0, len(ips))
+	for _, ip := range ips {
+		if e.allowIP(ip) {
+			allowed = append(allowed, ip)
+		}
+	}
+	if len(allowed) == 0 {
+		return nil, &EgressError{Addr: address, Reason: "ip denied"}
+	}
+	return allowed, nil
+}
+
+// DialContext dials the allowed addresses of the destination in order.
+func (e *EgressPolicy) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	addrs, err := e.Resolve(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, addr := range addrs {
+		var conn net.Conn
+		if conn, err = e.dialer.DialContext(ctx, network, addr); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+func (e *EgressPolicy) allowPort(port int) bool {
+	if len(e.allowPorts) == 0 {
+		return true
+	}
+	for _, r := range e.allowPorts {
+		if port >= r.from && port <= r.to {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *EgressPolicy) allowIP(ip net.IP) bool {
+	if containsSubnet(e.denySubnets, ip) {
+		return false
+	}
+	if len(e.allowSubnets) > 0 {
+		return containsSubnet(e.allowSubnets, ip)
+	}
+	return e.allowPrivate || !isPrivateIP(ip)
+}
+
+// dialEgress dials the destination for a client, the egress policy is
+// bypassed if it is not set.
+func (p *ProxyService) dialEgress(ctx context.Context, network, address string) (net.Conn, error) {
+	e := p.egress.Load()
+	if e == nil {
+		return p.dialer.DialContext(ctx, network, address)
+	}
+	return e.DialContext(ctx, network, address)
+}
+
+// dial dials the destination for the client of bs with the egress policy of its peer.
+func (p *ProxyService) dial(bs *BufReaderStream, address string) (net.Conn, error) {
+	pl := p.policyOf(bs)
+	if !pl.AllowProxy() {
+		return nil, &EgressError{Addr: address, Reason: "proxy is not allowed by policy " + pl.String()}
+	}
+	if e := p.egressOf(pl); e != nil {
+		return e.DialContext(p.ctx, "tcp", address)
+	}
+	return p.dialer.DialContext(p.ctx, "tcp", address)
+}
+
+// WithEgressPolicy restricts the destinations dialed for the clients.
+func WithEgressPolicy(e *EgressPolicy) Option {
+	return func(p *ProxyService) {
+		p.egress.Store(e)
+	}
+}
+
+// SetEgressPolicy restricts the destinations dialed for the clients, nil allows all.
+// It can be called while serving.
+func (p *ProxyService) SetEgressPolicy(e *EgressPolicy) {
+	p.egress.Store(e)
+	// the pooled connections were dialed with the old policy.
+	p.transport.CloseIdleConnections()
+}
+
+func isEgressDenied(err error) bool {
+	var e *EgressError
+	return errors.As(err, &e)
+}
+
+func isPrivateIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() ||
+		containsSubnet(specialSubnets, ip)
+}
+
+// matchHost matches the name with the patterns:
+// ".example.com" matches example.com and its subdomains,
+// "*.example.com" is a glob, others match the exact name.
+func matchHost(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		switch {
+		case strings.HasPrefix(pattern, "."):
+			if name == pattern[1:] || strings.HasSuffix(name, pattern) {
+				return true
+			}
+		case strings.ContainsAny(pattern, "*?["):
+			if ok, _ := path.Match(pattern, name); ok {
+				return true
+			}
+		case name == pattern:
+			return true
+		}
+	}
+	return false
+}
+
+func parseHostPatterns(ss []string) ([]string, error) {
+	patterns := make([]string, 0, len(ss))
+	for _, s := range ss {
+		pattern := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(s)), ".")
+		if pattern == "" || pattern == "." {
+			return nil, fmt.Errorf("invalid host pattern: %q", s)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid host pattern %q: %w", s, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+func parseSubnets(ss []string) ([]*net.IPNet, error) {
+	subnets := make([]*net.IPNet, 0, len(ss))
+	for _, s := range ss {
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing subnet: %w", err)
+		}
+		subnets = append(subnets, ipnet)
+	}
+	return subnets, nil
+}
+
+func containsSubnet(subnets []*net.IPNet, ip net.IP) bool {
+	for _, ipnet := range subnets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func mustParseCIDRs(ss ...string) []*net.IPNet {
+	subnets, err := parseSubnets(ss)
+	if err != nil {
+		panic(err)
+	}
+	return subnets
+}
@@ -0,0 +1,169 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/p2pdao/libp2p-proxy/config"
+)
+
+func TestMatchHost(t *testing.T) {
+	patterns := []string{".example.com", "*.corp", "exact.org"}
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"example.com", true},
+		{"www.example.com", true},
+		{"a.b.example.com", true},
+		{"badexample.com", false},
+		{"example.com.evil", false},
+		{"db.corp", true},
+		{"a.db.corp", true},
+		{"corp", false},
+		{"exact.org", true},
+		{"www.exact.org", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := matchHost(patterns, tt.name); got != tt.want {
+			t.Errorf("matchHost(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestIsPrivateIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"127.0.0.1", true},
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"192.168.1.1", true},
+		{"169.254.169.254", true},
+		{"0.0.0.0", true},
+		{"100.64.0.1", true},
+		{"198.18.0.1", true},
+		{"224.0.0.1", true},
+		{"::1", true},
+		{"fe80::1", true},
+		{"fd00::1", true},
+		{"::", true},
+		{"::ffff:127.0.0.1", true},
+		{"8.8.8.8", false},
+		{"93.184.216.34", false},
+		{"2606:4700::1111", false},
+	}
+	for _, tt := range tests {
+		if got := isPrivateIP(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("isPrivateIP(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestEgressResolve(t *testing.T) {
+	tests := []struct {
+		name   string
+		cfg    config.EgressConfig
+		addr   string
+		want   []string
+		reason string // of the EgressError, "" if allowed
+	}{
+		{name: "public", addr: "8.8.8.8:443", want: []string{"8.8.8.8:443"}},
+		{name: "loopback denied by default", addr: "127.0.0.1:80", reason: "ip denied"},
+		{name: "metadata denied by default", addr: "169.254.169.254:80", reason: "ip denied"},
+		{name: "ipv6 loopback denied by default", addr: "[::1]:80", reason: "ip denied"},
+		{name: "unspecified denied by default", addr: "0.0.0.0:80", reason: "ip denied"},
+		{name: "carrier-grade nat denied by default", addr: "100.64.0.1:80", reason: "ip denied"},
+		{name: "resolved name denied by ip", addr: "localhost:80", reason: "ip denied"},
+		{name: "allow private", cfg: config.EgressConfig{AllowPrivate: true}, addr: "127.0.0.1:80", want: []string{"127.0.0.1:80"}},
+		{
+			name: "deny subnet beats allow private",
+			cfg:  config.EgressConfig{AllowPrivate: true, DenySubnets: []string{"127.0.0.0/8"}},
+			addr: "127.0.0.1:80", reason: "ip denied",
+		},
+		{
+			name: "deny subnet beats allow subnet",
+			cfg:  config.EgressConfig{AllowSubnets: []string{"203.0.113.0/24"}, DenySubnets: []string{"203.0.113.0/28"}},
+			addr: "203.0.113.5:80", reason: "ip denied",
+		},
+		{
+			name: "allow subnet restricts",
+			cfg:  config.EgressConfig{AllowSubnets: []string{"203.0.113.0/24"}},
+			addr: "8.8.8.8:80", reason: "ip denied",
+		},
+		{
+			name: "allow subnet of private",
+			cfg:  config.EgressConfig{AllowSubnets: []string{"10.0.0.0/8"}},
+			addr: "10.1.2.3:80", want: []string{"10.1.2.3:80"},
+		},
+		{
+			name: "port not allowed",
+			cfg:  config.EgressConfig{AllowPorts: []string{"443", "8000-9000"}},
+			addr: "8.8.8.8:80", reason: "port",
+		},
+		{
+			name: "port in range",
+			cfg:  config.EgressConfig{AllowPorts: []string{"443", "8000-9000"}},
+			addr: "8.8.8.8:8080", want: []string{"8.8.8.8:8080"},
+		},
+		{
+			name: "host denied",
+			cfg:  config.EgressConfig{DenyHosts: []string{".internal.example.com"}},
+			addr: "DB.Internal.Example.com.:5432", reason: "host denied",
+		},
+		{
+			name: "deny host beats allow host",
+			cfg:  config.EgressConfig{AllowHosts: []string{"*.corp"}, DenyHosts: []string{"db.corp"}},
+			addr: "db.corp:80", reason: "host denied",
+		},
+		{
+			name: "host not in allow list",
+			cfg:  config.EgressConfig{AllowHosts: []string{"*.corp"}},
+			addr: "8.8.8.8:80", reason: "host not in allow list",
+		},
+		{
+			name: "allowed host is checked by ip",
+			cfg:  config.EgressConfig{AllowHosts: []string{"localhost"}},
+			addr: "localhost:80", reason: "ip denied",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := NewEgressPolicy(tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := e.Resolve(context.Background(), tt.addr)
+			if tt.reason != "" {
+				var ee *EgressError
+				if !errors.As(err, &ee) || ee.Reason != tt.reason {
+					t.Fatalf("Resolve(%s) = %v, %v, want the reason %q", tt.addr, got, err, tt.reason)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tt.want) || got[0] != tt.want[0] {
+				t.Errorf("Resolve(%s) = %v, want %v", tt.addr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEgressDefaultDeniesPrivate(t *testing.T) {
+	// the policy of the default config
+	e, err := NewEgressPolicy(config.Default().Egress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range []string{"127.0.0.1:22", "169.254.169.254:80", "10.0.0.1:80", "[fe80::1]:80"} {
+		if _, err := e.Resolve(context.Background(), addr); !isEgressDenied(err) {
+			t.Errorf("Resolve(%s) error = %v, want denied", addr, err)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package protocol
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const maxForwardNameSize = 255
+
+type forwardTarget struct {
+	addr string
+	peer peer.ID // the only peer allowed to use the forward, empty allows every peer
+}
+
+// AddForwardTarget exposes the TCP address target as the named forward on ForwardID,
+// a non-empty allow restricts it to that peer.
+func (p *ProxyService) AddForwardTarget(name, target string, allow peer.ID) error {
+	if err := checkForwardName(name); err != nil {
+		return err
+	}
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		return fmt.Errorf("invalid target of forward %q: %v", name, err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.forwards[name]; ok {
+		return fmt.Errorf("duplicate forward %q", name)
+	}
+	p.forwards[name] = forwardTarget{addr: target, peer: allow}
+	return nil
+}
+
+// ForwardHandler dials the target of the named forward requested by the remote peer,
+// then tunnels the stream to it.
+func (p *ProxyService) ForwardHandler(s network.Stream) {
+	if err := s.Scope().SetService(ServiceName); err != nil {
+		Log.Errorf("error attaching stream to service: %s", err)
+		s.Reset()
+		return
+	}
+
+	s, release := p.policy(s.Conn().RemotePeer()).limitStream(s)
+	defer release()
+
+	bs := NewBufReaderStream(s)
+	defer bs.Close()
+
+	bs.SetReadDeadline(time.Now().Add(time.Second * 10))
+	name, err := readForwardName(bs)
+	if err != nil {
+		if shouldLogError(err) {
+			Log.Errorf("read forward request error: %s", err)
+		}
+		bs.Reset()
+		return
+	}
+	bs.SetReadDeadline(time.Time{})
+
+	remotePeer := s.Conn().RemotePeer()
+	p.mu.Lock()
+	ft, ok := p.forwards[name]
+	p.mu.Unlock()
+	if !ok || (ft.peer != "" && ft.peer != remotePeer) || !p.policy(remotePeer).AllowForward(name) {
+		Log.Warnf("forward %q is not allowed for peer %s", name, remotePeer)
+		fmt.Fprintf(bs, "error: unknown forward %q\n", name)
+		return
+	}
+
+	conn, err := net.DialTimeout("tcp", ft.addr, time.Second*30)
+	if err != nil {
+		Log.Warnf("forward %q dial %s error: %s", name, ft.addr, err)
+		fmt.Fprintf(bs, "error: dial %s failed\n", ft.addr)
+		return
+	}
+	defer conn.Close()
+
+	Log.Debugf("forward %q from %s to %s", name, remotePeer, ft.addr)
+	if _, err := bs.Write([]byte("ok\n")); err != nil {
+		return
+	}
+	if err := tunneling(conn, bs); shouldLogError(err) {
+		Log.Warn(err)
+	}
+}
+
+// ServeForward listens on the TCP address proxyAddr, every connection is
+// tunneled to the named forward of remotePeer.
+func (p *ProxyService) ServeForward(name, proxyAddr string, remotePeer peer.ID) error {
+	if err := checkForwardName(name); err != nil {
+		return err
+	}
+
+	ln, err := net.Listen("tcp", proxyAddr)
+	if err != nil {
+		return err
+	}
+
+	go p.Wait(ln.Close)
+
+	for {
+		conn, err := ln.Accept()
+		if err := p.ctx.Err(); err != nil {
+			return err
+		}
+
+		if err != nil {
+			return err
+		}
+		go p.forwardSideHandler(conn, name, remotePeer)
+	}
+}
+
+func (p *ProxyService) forwardSideHandler(conn net.Conn, name string, remotePeer peer.ID) {
+	defer conn.Close()
+
+	s, err := p.host.NewStream(p.ctx, remotePeer, ForwardID)
+	if err != nil {
+		Log.Errorf("forward %q to %s error: %s", name, remotePeer, err)
+		return
+	}
+
+	bs := NewBufReaderStream(s)
+	defer bs.Close()
+
+	if _, err := fmt.Fprintf(bs, "%s\n", name); err != nil {
+		Log.Errorf("forward %q to %s error: %s", name, remotePeer, err)
+		bs.Reset()
+		return
+	}
+
+	bs.SetReadDeadline(time.Now().Add(time.Second * 40))
+	line, err := bs.Reader.ReadString('\n')
+	if err != nil {
+		Log.Errorf("forward %q to %s error: %s", name, remotePeer, err)
+		bs.Reset()
+		return
+	}
+	bs.SetReadDeadline(time.Time{})
+
+	if line = strings.TrimSpace(line); line != "ok" {
+		Log.Errorf("forward %q to %s refused: %s", name, remotePeer, line)
+		return
+	}
+	if err := tunneling(bs, conn); shouldLogError(err) {
+		Log.Warn(err)
+	}
+}
+
+func readForwardName(bs *BufReaderStream) (string, error) {
+	line, err := bs.Reader.ReadSlice('\n')
+	if err != nil {
+		return "", err
+	}
+
+	name := strings.TrimSuffix(string(line), "\n")
+	return name, checkForwardName(name)
+}
+
+func checkForwardName(name string) error {
+	if name == "" || len(name) > maxForwardNameSize || strings.ContainsAny(name, "\r\n") {
+		return fmt.Errorf("invalid forward name: %q", name)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package protocol
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/p2pdao/libp2p-proxy/config"
+)
+
+// PeerIDHeader carries the authenticated remote peer ID to the handler of ServeHTTP,
+// any value sent by the client is overwritten.
+const PeerIDHeader = "X-Libp2p-Peer-ID"
+
+// WithForwardedHeaders configures the headers that annotate forwarded requests.
+func WithForwardedHeaders(cfg config.ForwardedConfig) Option {
+	return func(p *ProxyService) {
+		p.forwarded = cfg
+	}
+}
+
+// SetForwardedHeaders configures the headers that annotate forwarded requests.
+func (p *ProxyService) SetForwardedHeaders(cfg config.ForwardedConfig) {
+	p.forwarded = cfg
+}
+
+// addForwardedHeaders annotates the request forwarded for the client of bs
+// with Via, RFC 7239 Forwarded and X-Forwarded-For headers.
+func (p *ProxyService) addForwardedHeaders(bs *BufReaderStream, req *http.Request) {
+	cfg := p.forwarded
+	if cfg.Via {
+		req.Header.Add("Via", fmt.Sprintf("%d.%d %s", req.ProtoMajor, req.ProtoMinor, ServiceName))
+	}
+
+	if cfg.XForwardedFor {
+		if ip := bs.RemoteIP(); ip != nil {
+			xff := ip.String()
+			if prior := req.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+				xff = strings.Join(prior, ", ") + ", " + xff
+			}
+			req.Header.Set("X-Forwarded-For", xff)
+		}
+	}
+
+	if cfg.Forwarded {
+		req.Header.Add("Forwarded", fmt.Sprintf("for=%s;by=_%s;host=%q;proto=http",
+			forwardedNode(bs), p.host.ID(), req.Host))
+	}
+}
+
+// forwardedNode returns the client node of RFC 7239, a libp2p peer
+// is represented as an obfuscated identifier with its peer ID.
+func forwardedNode(bs *BufReaderStream) string {
+	if id, ok := bs.RemotePeer(); ok {
+		return "_" + id.String()
+	}
+
+	ip := bs.RemoteIP()
+	switch {
+	case ip == nil:
+		return "unknown"
+	case ip.To4() == nil:
+		return `"[` + ip.String() + `]"`
+	}
+	return ip.String()
+}
+
+// peerIDHandler sets PeerIDHeader from the remote address of the gostream
+// connection, it is the peer ID that authenticated the libp2p stream.
+func peerIDHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Set(PeerIDHeader, r.RemoteAddr)
+		h.ServeHTTP(w, r)
+	})
+}
@@ -1,50 +1,93 @@
 package protocol
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/textproto"
 	"strings"
+	"sync"
 	"time"
 )
 
+const httpIdleTimeout = 90 * time.Second
+
 func (p *ProxyService) httpHandler(bs *BufReaderStream) {
-	req, err := http.ReadRequest(bs.Reader)
-	if err != nil {
-		Log.Error(err)
-		writeHTTPError(bs, 400, err)
-		bs.CloseWrite()
-		return
-	}
+	for {
+		bs.SetReadDeadline(time.Now().Add(httpIdleTimeout))
+		req, err := http.ReadRequest(bs.Reader)
+		if err != nil {
+			if err == io.EOF {
+				return
+			}
+			Log.Error(err)
+			writeHTTPError(bs, 400, err)
+			bs.CloseWrite()
+			return
+		}
+		bs.SetReadDeadline(time.Time{})
 
-	isConnectProxy := strings.ToUpper(req.Method) == "CONNECT"
-	if !isConnectProxy && !strings.HasPrefix(req.RequestURI, "http://") {
-		err = fmt.Errorf("invalid http proxy request: %s, %s, %s", req.Method, req.Host, req.RequestURI)
-		writeHTTPError(bs, 400, err)
-		bs.CloseWrite()
-		return
-	}
+		user, ok := p.httpAuthenticate(bs, req)
+		if !ok {
+			bs.CloseWrite()
+			return
+		}
+		// never leak the proxy credentials to origin servers.
+		req.Header.Del("Proxy-Authorization")
 
-	if p.isP2PHttp(req.Host) {
-		if isConnectProxy {
-			fmt.Fprintf(bs, "HTTP/1.1 200 Connection Established\r\n\r\n")
-			p.p2phttpHandler(bs, nil)
-		} else {
-			p.p2phttpHandler(bs, req)
+		isConnectProxy := strings.ToUpper(req.Method) == "CONNECT"
+		if !isConnectProxy && !strings.HasPrefix(req.RequestURI, "http://") {
+			err = fmt.Errorf("invalid http proxy request: %s, %s, %s", req.Method, req.Host, req.RequestURI)
+			writeHTTPError(bs, 400, err)
+			bs.CloseWrite()
+			return
+		}
+
+		if p.isP2PHttp(req.Host) {
+			if isConnectProxy {
+				fmt.Fprintf(bs, "HTTP/1.1 200 Connection Established\r\n\r\n")
+				p.p2phttpHandler(bs, nil)
+			} else {
+				p.p2phttpHandler(bs, req)
+			}
+			return
+		}
+
+		if user != "" {
+			Log.Debugf("http user %q %s %s", user, req.Method, req.Host)
+		}
+
+		// CONNECT and protocol upgrades take over the client connection.
+		if isConnectProxy || isUpgradeRequest(req) {
+			p.httpTunnel(bs, req, isConnectProxy)
+			return
+		}
+
+		if !p.httpForward(bs, req) {
+			bs.CloseWrite()
+			return
 		}
-		return
 	}
+}
 
+// httpTunnel dials the origin server and tunnels the client connection to it.
+func (p *ProxyService) httpTunnel(bs *BufReaderStream, req *http.Request, isConnectProxy bool) {
 	host := req.Host
 	_, port, _ := net.SplitHostPort(req.Host)
 	if port == "" {
 		host = net.JoinHostPort(req.Host, "80")
 	}
-	conn, err := net.Dial("tcp", host)
+	conn, err := p.dial(bs, host)
 	if err != nil {
-		Log.Error(err)
-		writeHTTPError(bs, 502, err)
+		if isEgressDenied(err) {
+			Log.Warnf("%s, remote: %s", err, bs.RemoteAddr())
+			writeHTTPError(bs, 403, err)
+		} else {
+			Log.Error(err)
+			writeHTTPError(bs, 502, err)
+		}
 		bs.CloseWrite()
 		return
 	}
@@ -54,8 +97,8 @@ func (p *ProxyService) httpHandler(bs *BufReaderStream) {
 		fmt.Fprintf(bs, "HTTP/1.1 200 Connection Established\r\n\r\n")
 	} else {
 		go func() {
-			req.Header.Set("Connection", req.Header.Get("Proxy-Connection"))
 			req.Header.Del("Proxy-Connection")
+			p.addForwardedHeaders(bs, req)
 			err := req.Write(conn)
 			if err != nil {
 				conn.Close()
@@ -71,6 +114,162 @@ func (p *ProxyService) httpHandler(bs *BufReaderStream) {
 	}
 }
 
+// httpForward sends a plain HTTP request to the origin server through the
+// connection pool and streams the response back, it returns false if the
+// client connection can't be reused.
+func (p *ProxyService) httpForward(bs *BufReaderStream, req *http.Request) bool {
+	var body *expectContinueReader
+	if req.Body != nil && req.Body != http.NoBody &&
+		strings.EqualFold(req.Header.Get("Expect"), "100-continue") {
+		body = &expectContinueReader{ReadCloser: req.Body, w: bs}
+		req.Body = body
+	}
+
+	req.RequestURI = ""
+	removeHopHeaders(req.Header)
+	p.addForwardedHeaders(bs, req)
+	req = req.WithContext(p.ctx)
+
+	pl := p.policyOf(bs)
+	if !pl.AllowProxy() {
+		err := &EgressError{Addr: req.Host, Reason: "proxy is not allowed by policy " + pl.String()}
+		Log.Warnf("%s, remote: %s", err, bs.RemoteAddr())
+		writeHTTPError(bs, 403, err)
+		return false
+	}
+
+	resp, err := p.transportOf(pl).RoundTrip(req)
+	if err != nil {
+		Log.Warn(err)
+		if isEgressDenied(err) {
+			writeHTTPError(bs, 403, err)
+		} else {
+			writeHTTPError(bs, 502, err)
+		}
+		return false
+	}
+	defer resp.Body.Close()
+
+	removeHopHeaders(resp.Header)
+	// the client didn't send the body that the origin server refused,
+	// the connection can't be reused.
+	if req.Close || (body != nil && !body.stop()) {
+		resp.Close = true
+	}
+	if err := resp.Write(bs); err != nil {
+		if shouldLogError(err) {
+			Log.Warn(err)
+		}
+		return false
+	}
+	if resp.Close {
+		return false
+	}
+
+	// the origin server may respond before reading the whole body, the rest
+	// is discarded, or the next request would be read from it.
+	if !drainBody(req.Body) {
+		Log.Debugf("the request body of %s is not drained, close the connection", req.URL)
+		return false
+	}
+	return true
+}
+
+// maxDrainSize is the most bytes of a request body discarded to reuse the connection.
+const maxDrainSize = 256 << 10
+
+// drainBody discards the rest of the body, it reports whether the body ends
+// within maxDrainSize.
+func drainBody(body io.Reader) bool {
+	n, err := io.CopyN(io.Discard, body, maxDrainSize+1)
+	// the transport closes the body after sending it, the rest is discarded.
+	return n <= maxDrainSize && (err == io.EOF || errors.Is(err, http.ErrBodyReadAfterClose))
+}
+
+var errNotContinued = errors.New("the client is not continued to send the request body")
+
+// expectContinueReader sends "100 Continue" to the client when the
+// request body is read for the first time.
+type expectContinueReader struct {
+	io.ReadCloser
+	w io.Writer
+
+	mu        sync.Mutex
+	continued bool
+	stopped   bool
+}
+
+func (r *expectContinueReader) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	if !r.continued {
+		if r.stopped {
+			r.mu.Unlock()
+			return 0, errNotContinued
+		}
+		r.continued = true
+		if _, err := io.WriteString(r.w, "HTTP/1.1 100 Continue\r\n\r\n"); err != nil {
+			r.mu.Unlock()
+			return 0, err
+		}
+	}
+	r.mu.Unlock()
+	return r.ReadCloser.Read(p)
+}
+
+// stop stops sending "100 Continue" before the response is written to the
+// client, it reports whether it was sent.
+func (r *expectContinueReader) stop() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stopped = true
+	return r.continued
+}
+
+func (r *expectContinueReader) Close() error {
+	if !r.stop() {
+		// the client is still waiting for "100 Continue", don't wait for the body.
+		return nil
+	}
+	return r.ReadCloser.Close()
+}
+
+// hopHeaders are removed when forwarding, see RFC 7230 section 6.1.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func removeHopHeaders(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, f := range strings.Split(v, ",") {
+			if f = textproto.TrimString(f); f != "" {
+				h.Del(f)
+			}
+		}
+	}
+	for _, k := range hopHeaders {
+		h.Del(k)
+	}
+}
+
+func isUpgradeRequest(req *http.Request) bool {
+	for _, v := range req.Header.Values("Connection") {
+		for _, f := range strings.Split(v, ",") {
+			if strings.EqualFold(textproto.TrimString(f), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func writeHTTPError(w io.Writer, code int, err error) {
 	fmt.Fprintf(w, "HTTP/1.1 %d %s\r\n", code, http.StatusText(code))
 	fmt.Fprintf(w, "Server: %s\r\n", ServiceName)
@@ -81,3 +280,16 @@ func writeHTTPError(w io.Writer, code int, err error) {
 	fmt.Fprintf(w, "Connection: close\r\n\r\n")
 	fmt.Fprintf(w, "%s\n", msg)
 }
+
+func writeHTTPAuthRequired(w io.Writer) {
+	code := http.StatusProxyAuthRequired
+	msg := http.StatusText(code)
+	fmt.Fprintf(w, "HTTP/1.1 %d %s\r\n", code, msg)
+	fmt.Fprintf(w, "Server: %s\r\n", ServiceName)
+	fmt.Fprintf(w, "Date: %s\r\n", time.Now().Format(http.TimeFormat))
+	fmt.Fprintf(w, "Proxy-Authenticate: Basic realm=%q\r\n", ServiceName)
+	fmt.Fprintf(w, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(w, "Content-Length: %d\r\n", len(msg)+1)
+	fmt.Fprintf(w, "Connection: close\r\n\r\n")
+	fmt.Fprintf(w, "%s\n", msg)
+}
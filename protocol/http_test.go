@@ -0,0 +1,149 @@
+package protocol
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestHTTPProxy returns the address of a http proxy that dials any destination.
+func newTestHTTPProxy(ctx context.Context, t *testing.T) string {
+	p := &ProxyService{ctx: ctx, p2pHost: "p2p.to", dialer: &net.Dialer{Timeout: 5 * time.Second}}
+	p.transport = newTransport(p.dialEgress)
+	t.Cleanup(p.transport.CloseIdleConnections)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				p.httpHandler(NewBufReaderStream(conn))
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func readTestResponse(t *testing.T, r *bufio.Reader) (*http.Response, string) {
+	t.Helper()
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(body)
+}
+
+func TestHTTPForwardUnreadBody(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the origin server responds before reading the body, and drops the
+	// connection without "Connection: close".
+	origin, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer origin.Close()
+	go func() {
+		for {
+			conn, err := origin.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				body := req.URL.Path
+				fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+			}()
+		}
+	}()
+
+	conn, err := net.Dial("tcp", newTestHTTPProxy(ctx, t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	r := bufio.NewReader(conn)
+
+	// the body is sent after the response, the next request follows it.
+	body := strings.Repeat("GET /smuggled HTTP/1.1\r\n\r\n", 100)
+	fmt.Fprintf(conn, "POST http://%s/unread HTTP/1.1\r\nHost: %[1]s\r\nContent-Length: %d\r\n\r\n%s",
+		origin.Addr(), len(body), body[:10])
+	if resp, got := readTestResponse(t, r); resp.StatusCode != 200 || got != "/unread" {
+		t.Fatalf("first response = %d %q", resp.StatusCode, got)
+	}
+	fmt.Fprintf(conn, "%sGET http://%s/next HTTP/1.1\r\nHost: %[2]s\r\n\r\n", body[10:], origin.Addr())
+	if resp, got := readTestResponse(t, r); resp.StatusCode != 200 || got != "/next" {
+		t.Fatalf("second response = %d %q, want the next request", resp.StatusCode, got)
+	}
+}
+
+func TestHTTPForwardExpectContinueRefused(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/refused" {
+			http.Error(w, "too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer origin.Close()
+
+	conn, err := net.Dial("tcp", newTestHTTPProxy(ctx, t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	r := bufio.NewReader(conn)
+
+	// the body is sent after "100 Continue", the connection is kept alive.
+	fmt.Fprintf(conn, "PUT %s/accepted HTTP/1.1\r\nHost: %s\r\nExpect: 100-continue\r\nContent-Length: 4\r\n\r\n",
+		origin.URL, origin.Listener.Addr())
+	if resp, _ := readTestResponse(t, r); resp.StatusCode != http.StatusContinue {
+		t.Fatalf("response = %d, want 100 Continue", resp.StatusCode)
+	}
+	io.WriteString(conn, "data")
+	if resp, got := readTestResponse(t, r); resp.StatusCode != 200 || got != "data" || resp.Close {
+		t.Fatalf("response = %d %q close %v", resp.StatusCode, got, resp.Close)
+	}
+
+	// the body is never sent, it can't be told from the next request.
+	fmt.Fprintf(conn, "PUT %s/refused HTTP/1.1\r\nHost: %s\r\nExpect: 100-continue\r\nContent-Length: 4\r\n\r\n",
+		origin.URL, origin.Listener.Addr())
+	resp, _ := readTestResponse(t, r)
+	if resp.StatusCode != http.StatusRequestEntityTooLarge || !resp.Close {
+		t.Fatalf("response = %d close %v, want 413 and close", resp.StatusCode, resp.Close)
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Errorf("the connection is not closed: %v", err)
+	}
+}
@@ -0,0 +1,101 @@
+package protocol
+
+import (
+	"context"
+	"io"
+	"strings"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/libp2p/go-libp2p/p2p/discovery/mdns"
+	"github.com/libp2p/zeroconf/v2"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// MDNSServiceName is the mDNS service of the proxy server peers on the local network.
+const MDNSServiceName = "_libp2p-proxy._udp"
+
+const (
+	mdnsDomain    = "local"
+	dnsaddrPrefix = "dnsaddr="
+)
+
+// AdvertiseMDNS advertises the host as a proxy server peer on the local network
+// until the returned service is closed.
+func AdvertiseMDNS(h host.Host) (io.Closer, error) {
+	s := mdns.NewMdnsService(h, MDNSServiceName, nopNotifee{})
+	if err := s.Start(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// nopNotifee ignores the peers found by the mDNS service of a server peer.
+type nopNotifee struct{}
+
+func (nopNotifee) HandlePeerFound(peer.AddrInfo) {}
+
+// DiscoverMDNS finds the proxy server peers on the local network until ctx is
+// done, it only browses, so the host needn't listen. The peers allowed by allow
+// and supporting the proxy protocol are added before the other peers of the
+// group, the configured peers are the fallback. A nil allow allows all.
+func (g *PeerGroup) DiscoverMDNS(ctx context.Context, allow func(peer.ID) bool) {
+	entries := make(chan *zeroconf.ServiceEntry, 16)
+	go func() {
+		for entry := range entries {
+			for _, pi := range mdnsPeers(entry) {
+				if pi.ID == g.h.ID() || g.has(pi.ID) {
+					continue
+				}
+				if allow != nil && !allow(pi.ID) {
+					Log.Debugf("peer %s found by mDNS is not allowed", pi.ID)
+					continue
+				}
+				go g.addLocal(ctx, pi)
+			}
+		}
+	}()
+
+	if err := zeroconf.Browse(ctx, MDNSServiceName, mdnsDomain, entries); err != nil {
+		Log.Warnf("mDNS discovery error: %v", err)
+	}
+}
+
+// addLocal adds the peer found on the local network if it is a proxy server.
+func (g *PeerGroup) addLocal(ctx context.Context, pi peer.AddrInfo) {
+	ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
+
+	// the protocols are identified on connecting.
+	if err := g.h.Connect(ctx, pi); err != nil {
+		Log.Debugf("connecting to peer %s found by mDNS error: %v", pi.ID, err)
+		return
+	}
+	if protos, _ := g.h.Peerstore().SupportsProtocols(pi.ID, string(ID)); len(protos) == 0 {
+		Log.Debugf("peer %s found by mDNS is not a proxy server", pi.ID)
+		return
+	}
+	if g.add(pi, peerstore.AddressTTL, true) {
+		Log.Infof("discovered server peer %s on the local network", pi.ID)
+	}
+}
+
+// mdnsPeers returns the peers of the dnsaddr TXT records.
+func mdnsPeers(entry *zeroconf.ServiceEntry) []peer.AddrInfo {
+	addrs := make([]ma.Multiaddr, 0, len(entry.Text))
+	for _, txt := range entry.Text {
+		if !strings.HasPrefix(txt, dnsaddrPrefix) {
+			continue
+		}
+		if addr, err := ma.NewMultiaddr(strings.TrimPrefix(txt, dnsaddrPrefix)); err == nil {
+			addrs = append(addrs, addr)
+		}
+	}
+	peers, err := peer.AddrInfosFromP2pAddrs(addrs...)
+	if err != nil {
+		Log.Debugf("invalid mDNS entry %s: %v", entry.Instance, err)
+		return nil
+	}
+	return peers
+}
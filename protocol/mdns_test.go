@@ -0,0 +1,91 @@
+package protocol
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/libp2p/zeroconf/v2"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func TestMDNSPeers(t *testing.T) {
+	const id = "12D3KooWSPGy9bCrTRF5Nwsb3B6CQsZ9VGvEGPJ6ZT2ZWWCTXR3p"
+	pid, err := peer.Decode(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcp := ma.StringCast("/ip4/192.168.1.2/tcp/11211")
+	quic := ma.StringCast("/ip4/192.168.1.2/udp/11211/quic")
+
+	tests := []struct {
+		name string
+		text []string
+		want []peer.AddrInfo
+	}{
+		{
+			name: "dnsaddr records",
+			text: []string{"dnsaddr=" + tcp.String() + "/p2p/" + id, "dnsaddr=" + quic.String() + "/p2p/" + id},
+			want: []peer.AddrInfo{{ID: pid, Addrs: []ma.Multiaddr{tcp, quic}}},
+		},
+		{
+			name: "other records are ignored",
+			text: []string{"foo=bar", "dnsaddr=" + tcp.String() + "/p2p/" + id},
+			want: []peer.AddrInfo{{ID: pid, Addrs: []ma.Multiaddr{tcp}}},
+		},
+		{
+			name: "invalid addresses are ignored",
+			text: []string{"dnsaddr=/ip4/999.1.1.1/tcp/1/p2p/" + id, "dnsaddr=" + tcp.String() + "/p2p/" + id},
+			want: []peer.AddrInfo{{ID: pid, Addrs: []ma.Multiaddr{tcp}}},
+		},
+		{
+			name: "address without peer ID",
+			text: []string{"dnsaddr=" + tcp.String()},
+		},
+		{
+			name: "no records",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := mdnsPeers(&zeroconf.ServiceEntry{Text: tt.text})
+			if len(got) == 0 && len(tt.want) == 0 {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mdnsPeers() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddLocal(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn, err := mocknet.FullMeshLinked(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mn.Close()
+	hosts := mn.Hosts()
+	client, server, other := hosts[0], hosts[1], hosts[2]
+	server.SetStreamHandler(ID, func(s network.Stream) { s.Reset() })
+
+	g, err := NewPeerGroup(client, nil, nil, StrategyFailover)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.Add(peer.AddrInfo{ID: "configured"}, 0)
+	g.addLocal(ctx, peer.AddrInfo{ID: other.ID(), Addrs: other.Addrs()})
+	g.addLocal(ctx, peer.AddrInfo{ID: server.ID(), Addrs: server.Addrs()})
+
+	// the peer found on the local network is before the configured peers.
+	want := []peer.ID{server.ID(), "configured"}
+	if got := g.Peers(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Peers() = %v, want %v", got, want)
+	}
+}
@@ -14,6 +14,14 @@ import (
 )
 
 func (p *ProxyService) p2phttpHandler(bs *BufReaderStream, req *http.Request) {
+	if pl := p.policyOf(bs); !pl.AllowP2PHttp() {
+		err := fmt.Errorf("p2p http is not allowed by policy %s", pl)
+		Log.Warnf("%s, remote: %s", err, bs.RemoteAddr())
+		writeHTTPError(bs, 403, err)
+		bs.CloseWrite()
+		return
+	}
+
 	var err error
 	for {
 		bs.SetReadDeadline(time.Now().Add(time.Second * 10))
@@ -41,9 +49,12 @@ func (p *ProxyService) p2phttpHandler(bs *BufReaderStream, req *http.Request) {
 			return
 		}
 
+		req.Header.Del("Proxy-Authorization")
+		p.addForwardedHeaders(bs, req)
 		req.Host = pp.target.ID.String() // Let URL's Host take precedence.
 		req.URL.Path = pp.httpPath
-		req.Close = true
+		upgrade := isUpgradeRequest(req)
+		req.Close = !upgrade
 		if len(pp.target.Addrs) > 0 {
 			p.host.Peerstore().AddAddrs(pp.target.ID, pp.target.Addrs, peerstore.TempAddrTTL)
 		}
@@ -59,6 +70,21 @@ func (p *ProxyService) p2phttpHandler(bs *BufReaderStream, req *http.Request) {
 			return
 		}
 
+		if upgrade {
+			// the stream carries the upgraded protocol (such as WebSocket) after the response.
+			bs.SetReadDeadline(time.Time{})
+			if err := req.Write(s); err != nil {
+				Log.Warn(err)
+				s.Reset()
+				return
+			}
+			if err := tunneling(s, bs); shouldLogError(err) {
+				Log.Warn(err)
+			}
+			s.Close()
+			return
+		}
+
 		// Write the request while reading the response
 		go func() {
 			err := req.Write(s)
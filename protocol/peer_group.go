@@ -0,0 +1,495 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	kb "github.com/libp2p/go-libp2p-kbucket"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/libp2p/go-libp2p/core/routing"
+	"github.com/libp2p/go-libp2p/p2p/net/swarm"
+	"github.com/libp2p/go-libp2p/p2p/protocol/ping"
+	ma "github.com/multiformats/go-multiaddr"
+	msmux "github.com/multiformats/go-multistream"
+)
+
+// the strategies of a PeerGroup
+const (
+	StrategyFailover         = "failover"
+	StrategyRoundRobin       = "round-robin"
+	StrategyLeastLatency     = "least-latency"
+	StrategyLeastConnections = "least-connections"
+)
+
+const (
+	pingTimeout    = 5 * time.Second
+	resolveTimeout = time.Minute // of finding the addresses by the routing
+	lookupRetry    = time.Second // while the routing table is empty
+
+	// DefaultHealthCheckInterval is the interval of the health checks of a PeerGroup.
+	DefaultHealthCheckInterval = 30 * time.Second
+
+	// the backoff of reconnecting to an unhealthy peer
+	minReconnectBackoff = time.Second
+	maxReconnectBackoff = time.Minute
+)
+
+// ErrDisconnected is returned by PeerGroup.NewStream if no server peer is connected.
+var ErrDisconnected = errors.New("disconnected from the server peers")
+
+// PeerGroup is the server peers of a proxy listener, the streams are opened to
+// the peer chosen by the strategy. Every peer is supervised by Run: it is pinged
+// on the health check interval to keep the connection warm, and reconnected with
+// exponential backoff when it is unhealthy.
+type PeerGroup struct {
+	h        host.Host
+	routing  routing.PeerRouting // optional, re-resolves the addresses
+	strategy string
+
+	mu       sync.Mutex
+	peers    []*groupPeer
+	next     int             // the next peer of round-robin
+	ctx      context.Context // of Run, the added peers are supervised with it
+	interval time.Duration
+}
+
+type groupPeer struct {
+	id      peer.ID
+	healthy bool
+	rtt     time.Duration
+	conns   int
+	kick    chan struct{} // wakes up the supervisor
+}
+
+// PeerState is the connection state of a server peer.
+type PeerState struct {
+	Peer    peer.ID `json:"peer"`
+	Healthy bool    `json:"healthy"`
+	RTT     string  `json:"rtt,omitempty"`
+	Conns   int     `json:"conns"`
+}
+
+// NewPeerGroup returns the group of the server peers, the addresses are kept in
+// the peerstore and the connections are protected. An empty strategy is failover.
+// The peers are unhealthy until Check or Run pings them, more peers can be added
+// by Add. r resolves the addresses of the peers without any and re-resolves them
+// when the known ones fail, it can be nil.
+func NewPeerGroup(h host.Host, r routing.PeerRouting, peers []peer.AddrInfo, strategy string) (*PeerGroup, error) {
+	switch strategy {
+	case "":
+		strategy = StrategyFailover
+	case StrategyFailover, StrategyRoundRobin, StrategyLeastLatency, StrategyLeastConnections:
+	default:
+		return nil, fmt.Errorf("invalid server peers strategy: %q", strategy)
+	}
+
+	g := &PeerGroup{h: h, routing: r, strategy: strategy}
+	for _, pi := range peers {
+		g.Add(pi, peerstore.PermanentAddrTTL)
+	}
+	return g, nil
+}
+
+// Add adds a server peer with the addresses kept for ttl, it is supervised at
+// once if Run is running. It returns false if the peer is in the group.
+func (g *PeerGroup) Add(pi peer.AddrInfo, ttl time.Duration) bool {
+	return g.add(pi, ttl, false)
+}
+
+// add adds a server peer after the others, or before them if first.
+func (g *PeerGroup) add(pi peer.AddrInfo, ttl time.Duration, first bool) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for _, gp := range g.peers {
+		if gp.id == pi.ID {
+			return false
+		}
+	}
+
+	g.h.Peerstore().AddAddrs(pi.ID, pi.Addrs, ttl)
+	g.h.ConnManager().Protect(pi.ID, "proxy")
+	gp := &groupPeer{id: pi.ID, kick: make(chan struct{}, 1)}
+	if first {
+		g.peers = append([]*groupPeer{gp}, g.peers...)
+	} else {
+		g.peers = append(g.peers, gp)
+	}
+	if g.ctx != nil {
+		gp.wake()
+		go g.supervise(g.ctx, gp, g.interval)
+	}
+	return true
+}
+
+// Peers returns the server peers in order.
+func (g *PeerGroup) Peers() []peer.ID {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	ids := make([]peer.ID, len(g.peers))
+	for i, gp := range g.peers {
+		ids[i] = gp.id
+	}
+	return ids
+}
+
+func (g *PeerGroup) has(id peer.ID) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for _, gp := range g.peers {
+		if gp.id == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Strategy returns the strategy of choosing the peers.
+func (g *PeerGroup) Strategy() string {
+	return g.strategy
+}
+
+// Healthy returns the number of the healthy peers.
+func (g *PeerGroup) Healthy() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.healthy()
+}
+
+func (g *PeerGroup) healthy() int {
+	n := 0
+	for _, gp := range g.peers {
+		if gp.healthy {
+			n++
+		}
+	}
+	return n
+}
+
+// Connected reports whether a server peer is healthy, the streams fail with
+// ErrDisconnected if not.
+func (g *PeerGroup) Connected() bool {
+	return g.Healthy() > 0
+}
+
+// States returns the connection states of the peers in order.
+func (g *PeerGroup) States() []PeerState {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	states := make([]PeerState, len(g.peers))
+	for i, gp := range g.peers {
+		states[i] = PeerState{Peer: gp.id, Healthy: gp.healthy, Conns: gp.conns}
+		if gp.healthy {
+			states[i].RTT = gp.rtt.String()
+		}
+	}
+	return states
+}
+
+// NewStream opens a stream to the peer chosen by the strategy, the next healthy
+// peer is tried if it fails. Only the dial and connection errors mark the peer
+// unhealthy. release must be called when the stream is done.
+func (g *PeerGroup) NewStream(ctx context.Context, pid protocol.ID) (network.Stream, func(), error) {
+	tried := make(map[peer.ID]bool)
+	err := ErrDisconnected
+	for {
+		gp := g.pick(tried)
+		if gp == nil {
+			return nil, nil, err
+		}
+		tried[gp.id] = true
+
+		sctx, cancel := context.WithTimeout(ctx, pingTimeout)
+		s, e := g.h.NewStream(sctx, gp.id, pid)
+		cancel()
+		if e == nil {
+			return s, g.acquire(gp), nil
+		}
+		if ctx.Err() != nil {
+			// the caller gave up, it says nothing about the peer.
+			return nil, nil, ctx.Err()
+		}
+		err = e
+		if errors.Is(e, msmux.ErrNotSupported) {
+			// the peer is up, it doesn't serve the protocol.
+			Log.Warnf("peer %s doesn't support %s", gp.id, pid)
+			continue
+		}
+		Log.Warnf("creating stream to %s error: %v", gp.id, err)
+		g.setHealth(gp, false, 0)
+		gp.wake()
+	}
+}
+
+// pick chooses a healthy peer that is not tried, or nil if none.
+func (g *PeerGroup) pick(tried map[peer.ID]bool) *groupPeer {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var best *groupPeer
+	n := len(g.peers)
+	for i := 0; i < n; i++ {
+		idx := i
+		if g.strategy == StrategyRoundRobin {
+			idx = (g.next + i) % n
+		}
+		gp := g.peers[idx]
+		if !gp.healthy || tried[gp.id] {
+			continue
+		}
+
+		switch g.strategy {
+		case StrategyLeastLatency:
+			if best == nil || gp.rtt < best.rtt {
+				best = gp
+			}
+		case StrategyLeastConnections:
+			if best == nil || gp.conns < best.conns {
+				best = gp
+			}
+		default:
+			if g.strategy == StrategyRoundRobin {
+				g.next = (idx + 1) % n
+			}
+			return gp
+		}
+	}
+	return best
+}
+
+func (g *PeerGroup) acquire(gp *groupPeer) func() {
+	g.mu.Lock()
+	gp.conns++
+	g.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			g.mu.Lock()
+			gp.conns--
+			g.mu.Unlock()
+		})
+	}
+}
+
+func (g *PeerGroup) setHealth(gp *groupPeer, healthy bool, rtt time.Duration) {
+	g.mu.Lock()
+	changed := gp.healthy != healthy
+	gp.healthy = healthy
+	if healthy {
+		gp.rtt = rtt
+	}
+	n := g.healthy()
+	g.mu.Unlock()
+
+	if !changed {
+		return
+	}
+	if healthy {
+		Log.Infof("server peer %s is re-admitted, RTT: %s", gp.id, rtt)
+		if n == 1 {
+			Log.Infof("connected to the server peers %v", g.Peers())
+		}
+	} else {
+		Log.Warnf("server peer %s is unhealthy and removed", gp.id)
+		if n == 0 {
+			Log.Warnf("disconnected from the server peers %v, reconnecting", g.Peers())
+		}
+	}
+}
+
+// wake runs the supervisor of the peer now.
+func (gp *groupPeer) wake() {
+	select {
+	case gp.kick <- struct{}{}:
+	default:
+	}
+}
+
+// Check pings every peer once, it returns the number of the healthy peers.
+func (g *PeerGroup) Check(ctx context.Context) int {
+	g.mu.Lock()
+	peers := append([]*groupPeer(nil), g.peers...)
+	g.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, gp := range peers {
+		wg.Add(1)
+		go func(gp *groupPeer) {
+			defer wg.Done()
+			g.check(ctx, gp)
+		}(gp)
+	}
+	wg.Wait()
+	return g.Healthy()
+}
+
+func (g *PeerGroup) check(ctx context.Context, gp *groupPeer) error {
+	rtt, err := g.ping(ctx, gp.id)
+	if err != nil {
+		Log.Debugf("ping server peer %s error: %v", gp.id, err)
+	}
+	g.setHealth(gp, err == nil, rtt)
+	return err
+}
+
+// Run supervises every peer until ctx is done: the healthy peers are pinged on
+// the interval, the unhealthy ones are reconnected with exponential backoff, and
+// a dropped connection is reconnected at once. 0 uses DefaultHealthCheckInterval.
+func (g *PeerGroup) Run(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultHealthCheckInterval
+	}
+
+	nb := &network.NotifyBundle{
+		DisconnectedF: func(n network.Network, c network.Conn) {
+			if n.Connectedness(c.RemotePeer()) == network.Connected {
+				return
+			}
+			g.mu.Lock()
+			defer g.mu.Unlock()
+			for _, gp := range g.peers {
+				if gp.id == c.RemotePeer() {
+					gp.wake()
+				}
+			}
+		},
+	}
+	g.h.Network().Notify(nb)
+	defer g.h.Network().StopNotify(nb)
+
+	g.mu.Lock()
+	g.ctx, g.interval = ctx, interval
+	for _, gp := range g.peers {
+		go g.supervise(ctx, gp, interval)
+	}
+	g.mu.Unlock()
+	<-ctx.Done()
+}
+
+func (g *PeerGroup) supervise(ctx context.Context, gp *groupPeer, interval time.Duration) {
+	backoff := minReconnectBackoff
+	for {
+		g.mu.Lock()
+		healthy := gp.healthy
+		g.mu.Unlock()
+
+		wait := interval
+		if !healthy {
+			wait = backoff
+			if backoff *= 2; backoff > maxReconnectBackoff {
+				backoff = maxReconnectBackoff
+			}
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-gp.kick:
+			timer.Stop()
+		case <-timer.C:
+		}
+
+		if g.check(ctx, gp) == nil {
+			backoff = minReconnectBackoff
+		}
+	}
+}
+
+// ping connects to the peer if it is not connected and pings it.
+func (g *PeerGroup) ping(ctx context.Context, id peer.ID) (time.Duration, error) {
+	if g.h.Network().Connectedness(id) != network.Connected {
+		if err := g.connect(ctx, id); err != nil {
+			return 0, err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
+	res := <-ping.Ping(ctx, g.h, id)
+	return res.RTT, res.Error
+}
+
+// connect dials the known addresses of the peer, they are resolved by the routing
+// if none is known or the known ones fail. The lookup has its own timeout, it can
+// take longer than a dial on a cold routing table.
+func (g *PeerGroup) connect(ctx context.Context, id peer.ID) error {
+	// the supervisor has its own backoff.
+	clearDialBackoff(g.h, id)
+	if g.routing == nil || len(g.h.Peerstore().Addrs(id)) > 0 {
+		dctx, cancel := context.WithTimeout(ctx, pingTimeout)
+		err := g.h.Connect(dctx, peer.AddrInfo{ID: id})
+		cancel()
+		if err == nil || g.routing == nil {
+			return err
+		}
+	}
+
+	// no address is known, such as a peer ID only, or the known ones fail.
+	ctx, cancel := context.WithTimeout(ctx, resolveTimeout)
+	defer cancel()
+	return g.resolve(ctx, id)
+}
+
+// resolve finds the addresses of the peer by the routing and connects to the new
+// ones, they are kept in the peerstore for peerstore.AddressTTL.
+func (g *PeerGroup) resolve(ctx context.Context, id peer.ID) error {
+	// before the lookup, it may add the addresses to the peerstore.
+	known := make(map[string]bool)
+	for _, addr := range g.h.Peerstore().Addrs(id) {
+		known[string(addr.Bytes())] = true
+	}
+	pi, err := g.findPeer(ctx, id)
+	if err != nil {
+		return fmt.Errorf("find peer %s error: %w", id, err)
+	}
+
+	var addrs []ma.Multiaddr
+	for _, addr := range pi.Addrs {
+		if !known[string(addr.Bytes())] {
+			addrs = append(addrs, addr)
+		}
+	}
+	if len(addrs) == 0 {
+		return fmt.Errorf("no new address of peer %s is found", id)
+	}
+
+	Log.Infof("found new addresses of peer %s: %v", id, addrs)
+	g.h.Peerstore().AddAddrs(id, addrs, peerstore.AddressTTL)
+	clearDialBackoff(g.h, id)
+	return g.h.Connect(ctx, peer.AddrInfo{ID: id, Addrs: addrs})
+}
+
+// findPeer finds the peer by the routing, the lookup is retried until ctx is done
+// while the routing table of the DHT is empty, such as it is bootstrapping.
+func (g *PeerGroup) findPeer(ctx context.Context, id peer.ID) (peer.AddrInfo, error) {
+	for {
+		pi, err := g.routing.FindPeer(ctx, id)
+		if !errors.Is(err, kb.ErrLookupFailure) {
+			return pi, err
+		}
+		select {
+		case <-ctx.Done():
+			return pi, err
+		case <-time.After(lookupRetry):
+		}
+	}
+}
+
+func clearDialBackoff(h host.Host, id peer.ID) {
+	if sw, ok := h.Network().(*swarm.Swarm); ok {
+		sw.Backoff().Clear(id)
+	}
+}
@@ -0,0 +1,202 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/libp2p/go-libp2p/p2p/protocol/ping"
+	msmux "github.com/multiformats/go-multistream"
+)
+
+func TestPeerGroupPick(t *testing.T) {
+	type state struct {
+		healthy bool
+		rtt     time.Duration
+		conns   int
+	}
+	a, b, c := peer.ID("a"), peer.ID("b"), peer.ID("c")
+	ids := []peer.ID{a, b, c}
+
+	tests := []struct {
+		name     string
+		strategy string
+		states   []state
+		tried    map[peer.ID]bool
+		want     []peer.ID // of the successive picks, "" is nil
+	}{
+		{
+			name:     "failover first",
+			strategy: StrategyFailover,
+			states:   []state{{healthy: true}, {healthy: true}, {healthy: true}},
+			want:     []peer.ID{a, a, a},
+		},
+		{
+			name:     "failover skips unhealthy",
+			strategy: StrategyFailover,
+			states:   []state{{}, {healthy: true}, {healthy: true}},
+			want:     []peer.ID{b, b},
+		},
+		{
+			name:     "failover skips tried",
+			strategy: StrategyFailover,
+			states:   []state{{healthy: true}, {}, {healthy: true}},
+			tried:    map[peer.ID]bool{a: true},
+			want:     []peer.ID{c},
+		},
+		{
+			name:     "round-robin in turn",
+			strategy: StrategyRoundRobin,
+			states:   []state{{healthy: true}, {healthy: true}, {healthy: true}},
+			want:     []peer.ID{a, b, c, a},
+		},
+		{
+			name:     "round-robin skips unhealthy",
+			strategy: StrategyRoundRobin,
+			states:   []state{{healthy: true}, {}, {healthy: true}},
+			want:     []peer.ID{a, c, a},
+		},
+		{
+			name:     "least-latency",
+			strategy: StrategyLeastLatency,
+			states:   []state{{healthy: true, rtt: 30 * time.Millisecond}, {healthy: true, rtt: 10 * time.Millisecond}, {healthy: true, rtt: 20 * time.Millisecond}},
+			want:     []peer.ID{b, b},
+		},
+		{
+			name:     "least-latency skips unhealthy",
+			strategy: StrategyLeastLatency,
+			states:   []state{{healthy: true, rtt: 30 * time.Millisecond}, {rtt: 10 * time.Millisecond}, {healthy: true, rtt: 20 * time.Millisecond}},
+			want:     []peer.ID{c},
+		},
+		{
+			name:     "least-latency skips tried",
+			strategy: StrategyLeastLatency,
+			states:   []state{{healthy: true, rtt: 30 * time.Millisecond}, {healthy: true, rtt: 10 * time.Millisecond}, {healthy: true, rtt: 20 * time.Millisecond}},
+			tried:    map[peer.ID]bool{b: true},
+			want:     []peer.ID{c},
+		},
+		{
+			name:     "least-connections",
+			strategy: StrategyLeastConnections,
+			states:   []state{{healthy: true, conns: 2}, {healthy: true, conns: 3}, {healthy: true, conns: 1}},
+			want:     []peer.ID{c},
+		},
+		{
+			name:     "least-connections skips unhealthy",
+			strategy: StrategyLeastConnections,
+			states:   []state{{healthy: true, conns: 2}, {healthy: true, conns: 3}, {conns: 1}},
+			want:     []peer.ID{a},
+		},
+		{
+			name:     "none healthy",
+			strategy: StrategyRoundRobin,
+			states:   []state{{}, {}, {}},
+			want:     []peer.ID{""},
+		},
+		{
+			name:     "all tried",
+			strategy: StrategyLeastConnections,
+			states:   []state{{healthy: true}, {healthy: true}, {}},
+			tried:    map[peer.ID]bool{a: true, b: true},
+			want:     []peer.ID{""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := &PeerGroup{strategy: tt.strategy}
+			for i, s := range tt.states {
+				g.peers = append(g.peers, &groupPeer{id: ids[i], healthy: s.healthy, rtt: s.rtt, conns: s.conns})
+			}
+			for i, want := range tt.want {
+				var got peer.ID
+				if gp := g.pick(tt.tried); gp != nil {
+					got = gp.id
+				}
+				if got != want {
+					t.Errorf("pick #%d = %q, want %q", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestPeerGroupNewStreamHealth(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn, err := mocknet.FullMeshConnected(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mn.Close()
+	h, unsupported, serving, down := mn.Hosts()[0], mn.Hosts()[1], mn.Hosts()[2], mn.Hosts()[3]
+
+	const pid = "/test/stream"
+	ping.NewPingService(unsupported)
+	ping.NewPingService(serving)
+	ping.NewPingService(down)
+	serving.SetStreamHandler(pid, func(s network.Stream) { s.Close() })
+	down.SetStreamHandler(pid, func(s network.Stream) { s.Close() })
+
+	g, err := NewPeerGroup(h, nil, []peer.AddrInfo{{ID: unsupported.ID()}, {ID: down.ID()}, {ID: serving.ID()}}, StrategyFailover)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := g.Check(ctx); n != 3 {
+		t.Fatalf("Check() = %d healthy peers, want 3", n)
+	}
+	healthy := func() map[peer.ID]bool {
+		m := make(map[peer.ID]bool)
+		for _, st := range g.States() {
+			m[st.Peer] = st.Healthy
+		}
+		return m
+	}
+
+	// the caller gives up.
+	canceled, cancelStream := context.WithCancel(ctx)
+	cancelStream()
+	if _, _, err := g.NewStream(canceled, pid); !errors.Is(err, context.Canceled) {
+		t.Errorf("NewStream() of a canceled context error = %v", err)
+	}
+	for id, ok := range healthy() {
+		if !ok {
+			t.Errorf("peer %s is unhealthy after the caller canceled", id)
+		}
+	}
+
+	// the peer without the protocol is skipped, the unreachable one is unhealthy.
+	if err := mn.UnlinkPeers(h.ID(), down.ID()); err != nil {
+		t.Fatal(err)
+	}
+	if err := mn.DisconnectPeers(h.ID(), down.ID()); err != nil {
+		t.Fatal(err)
+	}
+	s, release, err := g.NewStream(ctx, pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	s.Reset()
+	if s.Conn().RemotePeer() != serving.ID() {
+		t.Errorf("NewStream() to %s, want %s", s.Conn().RemotePeer(), serving.ID())
+	}
+	want := map[peer.ID]bool{unsupported.ID(): true, down.ID(): false, serving.ID(): true}
+	for id, ok := range healthy() {
+		if ok != want[id] {
+			t.Errorf("peer %s healthy = %v, want %v", id, ok, want[id])
+		}
+	}
+
+	// no peer serves the protocol.
+	if _, _, err := g.NewStream(ctx, "/test/none"); !errors.Is(err, msmux.ErrNotSupported) {
+		t.Errorf("NewStream() of an unsupported protocol error = %v", err)
+	}
+	if !healthy()[unsupported.ID()] || !healthy()[serving.ID()] {
+		t.Error("the peers are unhealthy after an unsupported protocol")
+	}
+}
@@ -0,0 +1,305 @@
+package protocol
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"github.com/p2pdao/libp2p-proxy/config"
+)
+
+// Policy is the named capabilities of the peers assigned to it.
+// A nil Policy allows everything, it is used for the peers without policy.
+type Policy struct {
+	Name string
+
+	proxy     bool
+	p2pHttp   bool
+	forwards  map[string]struct{}
+	egress    *EgressPolicy
+	transport *http.Transport
+	bandwidth int64
+
+	mu       sync.Mutex
+	limiters map[peer.ID]*peerLimiter
+}
+
+type peerLimiter struct {
+	*rateLimiter
+	refs int
+}
+
+func newPolicy(name string, cfg config.PolicyConfig) (*Policy, error) {
+	pl := &Policy{
+		Name:      name,
+		proxy:     cfg.Proxy,
+		p2pHttp:   cfg.P2PHttp,
+		forwards:  make(map[string]struct{}, len(cfg.Forwards)),
+		bandwidth: cfg.Bandwidth,
+		limiters:  make(map[peer.ID]*peerLimiter),
+	}
+	for _, f := range cfg.Forwards {
+		pl.forwards[f] = struct{}{}
+	}
+	if cfg.Bandwidth < 0 {
+		return nil, fmt.Errorf("invalid bandwidth of policy %q: %d", name, cfg.Bandwidth)
+	}
+
+	if cfg.Egress != nil {
+		egress, err := NewEgressPolicy(*cfg.Egress)
+		if err != nil {
+			return nil, fmt.Errorf("policy %q: %w", name, err)
+		}
+		pl.egress = egress
+		pl.transport = newTransport(egress.DialContext)
+	}
+	return pl, nil
+}
+
+// AllowProxy reports whether the HTTP and SOCKS forward proxying is allowed.
+func (pl *Policy) AllowProxy() bool {
+	return pl == nil || pl.proxy
+}
+
+// AllowP2PHttp reports whether the http services of this peer, and the
+// p2p websites through the proxy are allowed.
+func (pl *Policy) AllowP2PHttp() bool {
+	return pl == nil || pl.p2pHttp
+}
+
+// AllowForward reports whether the named forward is allowed.
+func (pl *Policy) AllowForward(name string) bool {
+	if pl == nil {
+		return true
+	}
+	_, ok := pl.forwards[name]
+	if !ok {
+		_, ok = pl.forwards["*"]
+	}
+	return ok
+}
+
+func (pl *Policy) String() string {
+	if pl == nil {
+		return "<none>"
+	}
+	return pl.Name
+}
+
+// limitStream caps the bandwidth of the stream, the streams of the same peer
+// share a limiter. release must be called when the stream is done.
+func (pl *Policy) limitStream(s network.Stream) (network.Stream, func()) {
+	l, release := pl.limiter(s.Conn().RemotePeer())
+	if l == nil {
+		return s, release
+	}
+	return &limitedStream{Stream: s, limiter: l}, release
+}
+
+// limiter returns the shared limiter of the peer, nil if the bandwidth is
+// unlimited. release must be called when the peer's stream is done.
+func (pl *Policy) limiter(id peer.ID) (*rateLimiter, func()) {
+	if pl == nil || pl.bandwidth == 0 {
+		return nil, func() {}
+	}
+
+	pl.mu.Lock()
+	l, ok := pl.limiters[id]
+	if !ok {
+		l = &peerLimiter{rateLimiter: newRateLimiter(pl.bandwidth)}
+		pl.limiters[id] = l
+	}
+	l.refs++
+	pl.mu.Unlock()
+
+	var once sync.Once
+	return l.rateLimiter, func() {
+		once.Do(func() {
+			pl.mu.Lock()
+			if l.refs--; l.refs == 0 {
+				delete(pl.limiters, id)
+			}
+			pl.mu.Unlock()
+		})
+	}
+}
+
+// policyOf returns the policy of the remote peer of bs, nil for local connections.
+func (p *ProxyService) policyOf(bs *BufReaderStream) *Policy {
+	id, ok := bs.RemotePeer()
+	if !ok {
+		return nil
+	}
+	return p.policy(id)
+}
+
+func (p *ProxyService) policy(id peer.ID) *Policy {
+	acl := p.acl.Load()
+	if acl == nil {
+		return nil
+	}
+	return acl.Policy(id)
+}
+
+// egressOf returns the egress policy of pl, or the global one.
+func (p *ProxyService) egressOf(pl *Policy) *EgressPolicy {
+	if pl != nil && pl.egress != nil {
+		return pl.egress
+	}
+	return p.egress.Load()
+}
+
+// transportOf returns the connection pool of pl, the pools are not shared
+// between the egress policies.
+func (p *ProxyService) transportOf(pl *Policy) *http.Transport {
+	if pl != nil && pl.transport != nil {
+		return pl.transport
+	}
+	return p.transport
+}
+
+// WithACL enables the per-peer policies of the acl on the stream handlers.
+func WithACL(acl *ACLFilter) Option {
+	return func(p *ProxyService) {
+		p.acl.Store(acl)
+	}
+}
+
+// SetACL enables the per-peer policies of the acl on the stream handlers,
+// nil disables them. It can be called while serving.
+func (p *ProxyService) SetACL(acl *ACLFilter) {
+	p.acl.Store(acl)
+}
+
+// policyHandler denies the http requests of the peers without the p2phttp capability,
+// the remote address of the gostream connection is the peer ID.
+func (p *ProxyService) policyHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := peer.Decode(r.RemoteAddr)
+		if pl := p.policy(id); err != nil || !pl.AllowP2PHttp() {
+			Log.Warnf("p2p http is not allowed for peer %s by policy %s", r.RemoteAddr, pl)
+			http.Error(w, "p2p http is not allowed", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// limitListener caps the bandwidth of the gostream connections with the
+// policies of their peers, the remote address is the peer ID.
+type limitListener struct {
+	net.Listener
+	p *ProxyService
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	id, err := peer.Decode(c.RemoteAddr().String())
+	if err != nil {
+		return c, nil
+	}
+	limiter, release := l.p.policy(id).limiter(id)
+	if limiter == nil {
+		return c, nil
+	}
+	return &limitedConn{Conn: c, limiter: limiter, release: release}, nil
+}
+
+// CloseDisallowed closes the connections of the peers that the ACL doesn't allow
+// anymore, it returns the number of closed connections.
+func (p *ProxyService) CloseDisallowed() int {
+	acl := p.acl.Load()
+	if acl == nil {
+		return 0
+	}
+
+	n := 0
+	for _, c := range p.host.Network().Conns() {
+		if !acl.AllowConn(c) {
+			Log.Warnf("close the disallowed connection of peer %s, %s", c.RemotePeer(), c.RemoteMultiaddr())
+			c.Close()
+			n++
+		}
+	}
+	return n
+}
+
+// rateLimiter is a token bucket of bytes, the burst is one second.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(bytesPerSecond int64) *rateLimiter {
+	return &rateLimiter{rate: float64(bytesPerSecond), tokens: float64(bytesPerSecond), last: time.Now()}
+}
+
+// wait takes n tokens, it sleeps until the debt is paid.
+func (l *rateLimiter) wait(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	debt := l.tokens
+	l.mu.Unlock()
+
+	if debt < 0 {
+		time.Sleep(time.Duration(-debt / l.rate * float64(time.Second)))
+	}
+}
+
+type limitedStream struct {
+	network.Stream
+	limiter *rateLimiter
+}
+
+func (s *limitedStream) Read(b []byte) (int, error) {
+	n, err := s.Stream.Read(b)
+	if n > 0 {
+		s.limiter.wait(n)
+	}
+	return n, err
+}
+
+func (s *limitedStream) Write(b []byte) (int, error) {
+	s.limiter.wait(len(b))
+	return s.Stream.Write(b)
+}
+
+type limitedConn struct {
+	net.Conn
+	limiter *rateLimiter
+	release func()
+}
+
+func (c *limitedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.limiter.wait(n)
+	}
+	return n, err
+}
+
+func (c *limitedConn) Write(b []byte) (int, error) {
+	c.limiter.wait(len(b))
+	return c.Conn.Write(b)
+}
+
+func (c *limitedConn) Close() error {
+	c.release()
+	return c.Conn.Close()
+}
@@ -0,0 +1,237 @@
+package protocol
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	gostream "github.com/libp2p/go-libp2p-gostream"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+
+	"github.com/p2pdao/libp2p-proxy/config"
+)
+
+func TestPolicy(t *testing.T) {
+	var none *Policy
+	if !none.AllowProxy() || !none.AllowP2PHttp() || !none.AllowForward("ssh") {
+		t.Error("a nil policy doesn't allow everything")
+	}
+
+	tests := []struct {
+		name     string
+		cfg      config.PolicyConfig
+		proxy    bool
+		p2pHttp  bool
+		forwards map[string]bool
+	}{
+		{
+			name:     "nothing",
+			forwards: map[string]bool{"ssh": false, "*": false, "": false},
+		},
+		{
+			name:     "proxy and named forwards",
+			cfg:      config.PolicyConfig{Proxy: true, Forwards: []string{"ssh", "rdp"}},
+			proxy:    true,
+			forwards: map[string]bool{"ssh": true, "rdp": true, "web": false, "*": false},
+		},
+		{
+			name:     "all forwards",
+			cfg:      config.PolicyConfig{P2PHttp: true, Forwards: []string{"*"}},
+			p2pHttp:  true,
+			forwards: map[string]bool{"ssh": true, "web": true},
+		},
+	}
+	for _, tt := range tests {
+		pl, err := newPolicy(tt.name, tt.cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pl.AllowProxy() != tt.proxy {
+			t.Errorf("%s: AllowProxy() = %v, want %v", tt.name, pl.AllowProxy(), tt.proxy)
+		}
+		if pl.AllowP2PHttp() != tt.p2pHttp {
+			t.Errorf("%s: AllowP2PHttp() = %v, want %v", tt.name, pl.AllowP2PHttp(), tt.p2pHttp)
+		}
+		for name, want := range tt.forwards {
+			if got := pl.AllowForward(name); got != want {
+				t.Errorf("%s: AllowForward(%q) = %v, want %v", tt.name, name, got, want)
+			}
+		}
+	}
+
+	if _, err := newPolicy("negative", config.PolicyConfig{Bandwidth: -1}); err == nil {
+		t.Error("newPolicy() of a negative bandwidth is ok")
+	}
+}
+
+func TestPolicyOf(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn, err := mocknet.FullMeshConnected(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mn.Close()
+	h, member, other := mn.Hosts()[0], mn.Hosts()[1], mn.Hosts()[2]
+
+	const pid = "/test/policy"
+	member.SetStreamHandler(pid, func(s network.Stream) { s.Close() })
+	other.SetStreamHandler(pid, func(s network.Stream) { s.Close() })
+	stream := func(id peer.ID) *BufReaderStream {
+		s, err := h.NewStream(ctx, id, pid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Reset() })
+		return NewBufReaderStream(s)
+	}
+
+	p := &ProxyService{ctx: ctx}
+	if pl := p.policyOf(stream(member.ID())); pl != nil {
+		t.Errorf("policyOf() without acl = %s, want none", pl)
+	}
+
+	acl, err := NewACL(config.ACLConfig{
+		DefaultPolicy: "guest",
+		Policies: map[string]config.PolicyConfig{
+			"member": {Peers: []string{member.ID().String()}, Proxy: true},
+			"guest":  {},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.SetACL(acl)
+
+	if pl := p.policyOf(stream(member.ID())); pl.String() != "member" {
+		t.Errorf("policyOf() of the member = %s, want member", pl)
+	}
+	if pl := p.policyOf(stream(other.ID())); pl.String() != "guest" {
+		t.Errorf("policyOf() of the other peer = %s, want the default guest", pl)
+	}
+
+	// the local connections have no policy.
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	if pl := p.policyOf(NewBufReaderStream(server)); pl != nil {
+		t.Errorf("policyOf() of a local connection = %s, want none", pl)
+	}
+}
+
+func TestPolicyLimiter(t *testing.T) {
+	unlimited, err := newPolicy("unlimited", config.PolicyConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l, release := unlimited.limiter("a"); l != nil {
+		t.Error("limiter() of an unlimited policy is not nil")
+	} else {
+		release()
+	}
+
+	pl, err := newPolicy("limited", config.PolicyConfig{Bandwidth: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a1, releaseA1 := pl.limiter("a")
+	a2, releaseA2 := pl.limiter("a")
+	b, releaseB := pl.limiter("b")
+	if a1 != a2 {
+		t.Error("the streams of the same peer don't share the limiter")
+	}
+	if a1 == b {
+		t.Error("the streams of different peers share the limiter")
+	}
+
+	releaseA1()
+	releaseA1() // release is idempotent
+	if _, ok := pl.limiters["a"]; !ok {
+		t.Error("the limiter is removed while a stream of the peer is open")
+	}
+	releaseA2()
+	releaseB()
+	if len(pl.limiters) != 0 {
+		t.Errorf("%d limiters are left after the release", len(pl.limiters))
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(1000)
+
+	// the burst is one second.
+	start := time.Now()
+	l.wait(1000)
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("wait() of the burst took %s", d)
+	}
+
+	start = time.Now()
+	l.wait(300)
+	if d := time.Since(start); d < 250*time.Millisecond || d > time.Second {
+		t.Errorf("wait() of 300 bytes at 1000/s took %s, want about 300ms", d)
+	}
+}
+
+func TestServeHTTPProtocolBandwidth(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn, err := mocknet.FullMeshConnected(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mn.Close()
+	client, server := mn.Hosts()[0], mn.Hosts()[1]
+
+	acl, err := NewACL(config.ACLConfig{
+		DefaultPolicy: "slow",
+		Policies:      map[string]config.PolicyConfig{"slow": {P2PHttp: true, Bandwidth: 10000}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewProxyService(ctx, server, "p2p.to", WithACL(acl))
+	defer p.Close()
+
+	body := strings.Repeat("x", 20000)
+	go p.ServeHTTP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	}), nil)
+
+	hc := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return gostream.Dial(ctx, client, server.ID(), P2PHttpID)
+		},
+	}}
+	defer hc.CloseIdleConnections()
+
+	// the server may not serve yet.
+	start := time.Now()
+	var resp *http.Response
+	for i := 0; i < 50; i++ {
+		if resp, err = hc.Get("http://p2p/"); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || len(got) != len(body) {
+		t.Fatalf("read %d bytes, %v", len(got), err)
+	}
+	// 10000 bytes are the burst, the rest takes a second.
+	if d := time.Since(start); d < 800*time.Millisecond {
+		t.Errorf("20000 bytes at 10000/s took %s, the bandwidth is not limited", d)
+	}
+}
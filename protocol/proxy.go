@@ -4,8 +4,11 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -14,37 +17,83 @@ import (
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/protocol"
+
+	"github.com/p2pdao/libp2p-proxy/config"
 )
 
 const (
 	P2PHttpID   protocol.ID = "/http"
 	ID          protocol.ID = "/p2pdao/libp2p-proxy/1.0.0"
+	UDPID       protocol.ID = "/p2pdao/libp2p-proxy/udp/1.0.0"
+	ForwardID   protocol.ID = "/p2pdao/libp2p-proxy/forward/1.0.0"
 	ServiceName string      = "p2pdao.libp2p-proxy"
 )
 
 var Log = logging.Logger("libp2p-proxy")
 
 type ProxyService struct {
-	ctx     context.Context
-	host    host.Host
-	http    *http.Server
-	p2pHost string
+	ctx       context.Context
+	host      host.Host
+	p2pHost   string
+	forwarded config.ForwardedConfig
+	egress    atomic.Pointer[EgressPolicy]
+	acl       atomic.Pointer[ACLFilter]
+	dialer    *net.Dialer
+
+	// transport is the origin connection pool for plain HTTP forward-proxy requests.
+	transport *http.Transport
+
+	mu       sync.Mutex
+	servers  map[protocol.ID]*http.Server
+	forwards map[string]forwardTarget
 }
 
-func NewProxyService(ctx context.Context, h host.Host, p2pHost string) *ProxyService {
-	ps := &ProxyService{ctx, h, nil, p2pHost}
+// Option configures the ProxyService before its stream handlers are registered.
+type Option func(*ProxyService)
+
+// NewProxyService registers the stream handlers of the proxy on the host. The
+// options are applied before, so no stream is served without the ACL and the
+// egress policy of them.
+func NewProxyService(ctx context.Context, h host.Host, p2pHost string, opts ...Option) *ProxyService {
+	ps := &ProxyService{
+		ctx:      ctx,
+		host:     h,
+		p2pHost:  p2pHost,
+		servers:  make(map[protocol.ID]*http.Server),
+		forwards: make(map[string]forwardTarget),
+		dialer: &net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		},
+	}
+	ps.transport = newTransport(ps.dialEgress)
+	for _, opt := range opts {
+		opt(ps)
+	}
 	h.SetStreamHandler(ID, ps.Handler)
+	h.SetStreamHandler(UDPID, ps.UDPHandler)
+	h.SetStreamHandler(ForwardID, ps.ForwardHandler)
 	return ps
 }
 
 // Close terminates this listener. It will no longer handle any
 // incoming streams
 func (p *ProxyService) Close() error {
-	if s := p.http; s != nil {
+	p.mu.Lock()
+	servers := p.servers
+	p.servers = make(map[protocol.ID]*http.Server)
+	p.mu.Unlock()
+
+	if len(servers) > 0 {
 		c, cancel := context.WithTimeout(context.Background(), time.Second*10)
 		defer cancel()
-		p.http = nil
-		s.Shutdown(c)
+		for _, s := range servers {
+			s.Shutdown(c)
+		}
+	}
+	p.transport.CloseIdleConnections()
+	if acl := p.acl.Load(); acl != nil {
+		acl.rules.Load().closeIdleConnections()
 	}
 	return p.host.Close()
 }
@@ -68,6 +117,15 @@ func (p *ProxyService) Handler(s network.Stream) {
 		return
 	}
 
+	pl := p.policy(s.Conn().RemotePeer())
+	if !pl.AllowProxy() && !pl.AllowP2PHttp() {
+		Log.Warnf("proxy is not allowed for peer %s by policy %s", s.Conn().RemotePeer(), pl)
+		s.Reset()
+		return
+	}
+
+	s, release := pl.limitStream(s)
+	defer release()
 	p.handler(NewBufReaderStream(s))
 }
 
@@ -84,37 +142,74 @@ func (p *ProxyService) handler(bs *BufReaderStream) {
 		return
 	}
 
-	if IsSocks5(b[0]) {
+	switch {
+	case IsSocks5(b[0]):
 		p.socks5Handler(bs)
-	} else {
+	case IsSocks4(b[0]):
+		p.socks4Handler(bs)
+	default:
 		p.httpHandler(bs)
 	}
 }
 
+// SiteID returns the protocol of a named http site, the proxy reaches it with
+// /p2p/$peer_id/x/$name/http/$http_path.
+func SiteID(name string) protocol.ID {
+	return protocol.ID("/x/" + name + "/http")
+}
+
+// NewHTTPServer returns the http.Server with the default timeouts of ServeHTTP.
+func NewHTTPServer() *http.Server {
+	s := new(http.Server)
+	s.ReadHeaderTimeout = 20 * time.Second
+	s.ReadTimeout = 60 * time.Second
+	s.WriteTimeout = 120 * time.Second
+	s.IdleTimeout = 90 * time.Second
+	return s
+}
+
+// ServeHTTP serves the http handler on P2PHttpID.
 func (p *ProxyService) ServeHTTP(handler http.Handler, s *http.Server) error {
-	if p.http != nil {
-		return fmt.Errorf("http.Server exists")
-	}
+	return p.ServeHTTPProtocol(P2PHttpID, handler, s)
+}
+
+// ServeHTTPProtocol serves the http handler on the protocol, every protocol has
+// its own http.Server, a nil s uses NewHTTPServer.
+func (p *ProxyService) ServeHTTPProtocol(pid protocol.ID, handler http.Handler, s *http.Server) error {
 	if handler == nil {
 		return fmt.Errorf("http handler is nil")
 	}
-	l, err := gostream.Listen(p.host, P2PHttpID)
-	if err != nil {
-		return err
+	if s == nil {
+		s = NewHTTPServer()
 	}
 
-	if s == nil {
-		s = new(http.Server)
-		s.ReadHeaderTimeout = 20 * time.Second
-		s.ReadTimeout = 60 * time.Second
-		s.WriteTimeout = 120 * time.Second
-		s.IdleTimeout = 90 * time.Second
+	p.mu.Lock()
+	if _, ok := p.servers[pid]; ok {
+		p.mu.Unlock()
+		return fmt.Errorf("http.Server exists: %s", pid)
 	}
-	s.Handler = handler
-	p.http = s
+	l, err := gostream.Listen(p.host, pid)
+	if err != nil {
+		p.mu.Unlock()
+		return err
+	}
+	s.Handler = p.policyHandler(peerIDHandler(handler))
+	p.servers[pid] = s
+	p.mu.Unlock()
 
 	go p.Wait(nil)
-	return s.Serve(l)
+	return s.Serve(&limitListener{Listener: l, p: p})
+}
+
+// newTransport returns the origin connection pool with the dial function.
+func newTransport(dial func(ctx context.Context, network, addr string) (net.Conn, error)) *http.Transport {
+	return &http.Transport{
+		DialContext:           dial,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		DisableCompression:    true,
+	}
 }
 
 func (p *ProxyService) isP2PHttp(host string) bool {
@@ -1,49 +1,384 @@
 package protocol
 
 import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
 	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
 
 	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/txthinking/socks5"
 )
 
+// the protocols of a proxy listener
+const (
+	ProtocolHTTP   = "http"
+	ProtocolSocks5 = "socks5"
+	ProtocolSocks4 = "socks4"
+)
+
+// Listener is a local proxy listener, it tunnels the connections to its server
+// peers, or serves them itself in standalone mode. The listeners of a ProxyService
+// share the libp2p host.
+type Listener struct {
+	p         *ProxyService
+	addr      string
+	group     *PeerGroup      // nil in standalone mode
+	protocols map[string]bool // nil allows all
+	creds     atomic.Pointer[Credentials]
+}
+
+// NewListener returns a listener on addr to the server peers of group, a nil
+// group runs in standalone mode. The protocols are "http", "socks5" and "socks4",
+// empty allows all.
+func (p *ProxyService) NewListener(addr string, group *PeerGroup, protocols []string) (*Listener, error) {
+	l := &Listener{p: p, addr: addr, group: group}
+	if len(protocols) > 0 {
+		l.protocols = make(map[string]bool, len(protocols))
+		for _, proto := range protocols {
+			switch proto {
+			case ProtocolHTTP, ProtocolSocks5, ProtocolSocks4:
+				l.protocols[proto] = true
+			default:
+				return nil, fmt.Errorf("invalid proxy protocol %q of %s", proto, addr)
+			}
+		}
+	}
+	return l, nil
+}
+
+// Serve serves a proxy listener on proxyAddr to remotePeer, or in standalone
+// mode if remotePeer is the host itself. It is NewListener with a group of the
+// one peer, the group is supervised until the ProxyService is done.
 func (p *ProxyService) Serve(proxyAddr string, remotePeer peer.ID) error {
-	ln, err := net.Listen("tcp", proxyAddr)
+	var group *PeerGroup
+	if remotePeer != p.host.ID() {
+		g, err := NewPeerGroup(p.host, nil, []peer.AddrInfo{{ID: remotePeer}}, StrategyFailover)
+		if err != nil {
+			return err
+		}
+		g.Check(p.ctx)
+		go g.Run(p.ctx, 0)
+		group = g
+	}
+
+	l, err := p.NewListener(proxyAddr, group, nil)
 	if err != nil {
 		return err
 	}
+	return l.Serve()
+}
 
-	go p.Wait(ln.Close)
+func (l *Listener) Addr() string {
+	return l.addr
+}
+
+// Group returns the server peers, nil in standalone mode.
+func (l *Listener) Group() *PeerGroup {
+	return l.group
+}
+
+// SetCredentials enables authentication on the listener,
+// nil disables it. It can be called while serving.
+func (l *Listener) SetCredentials(c *Credentials) {
+	l.creds.Store(c)
+}
+
+func (l *Listener) Serve() error {
+	ln, err := net.Listen("tcp", l.addr)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		<-l.p.ctx.Done()
+		ln.Close()
+	}()
 
 	for {
 		conn, err := ln.Accept()
-		if err := p.ctx.Err(); err != nil {
+		if err := l.p.ctx.Err(); err != nil {
 			return err
 		}
 
 		if err != nil {
 			return err
 		}
-		go p.sideHandler(conn, remotePeer)
+		go l.handler(conn)
 	}
 }
 
-func (p *ProxyService) sideHandler(conn net.Conn, remotePeer peer.ID) {
+// disabled returns the protocol of the first byte if it is not enabled, or "".
+func (l *Listener) disabled(b byte) string {
+	proto := ProtocolHTTP
+	switch {
+	case IsSocks5(b):
+		proto = ProtocolSocks5
+	case IsSocks4(b):
+		proto = ProtocolSocks4
+	}
+	if l.protocols == nil || l.protocols[proto] {
+		return ""
+	}
+	return proto
+}
+
+func (l *Listener) handler(conn net.Conn) {
 	defer conn.Close()
 
+	p := l.p
+	bs := NewBufReaderStream(conn)
+	bs.listener = l
+	b, err := bs.Reader.Peek(1)
+	if err != nil {
+		return
+	}
+
+	if proto := l.disabled(b[0]); proto != "" {
+		Log.Warnf("%s is not enabled on proxy listener %s, remote: %s", proto, l.addr, bs.RemoteAddr())
+		if proto == ProtocolHTTP {
+			writeHTTPError(bs, http.StatusForbidden, errors.New("http proxy is not enabled on this listener"))
+		}
+		return
+	}
+
 	// standalone mode
-	if remotePeer == p.host.ID() {
-		p.handler(NewBufReaderStream(conn))
+	if l.group == nil {
+		p.handler(bs)
+		return
+	}
+
+	if IsSocks5(b[0]) {
+		p.socks5SideHandler(bs, l.group)
+		return
+	}
+
+	if l.creds.Load() != nil {
+		if IsSocks4(b[0]) {
+			// rejects the client locally, SOCKS4 can't be authenticated.
+			p.socks4Handler(bs)
+		} else {
+			p.httpSideHandler(bs, l.group)
+		}
+		return
+	}
+	p.tunnelSide(bs, l.group, nil, func(err error) {
+		if IsSocks4(b[0]) {
+			writeSocks4Reply(bs, socks4Rejected, nil)
+		} else {
+			writeHTTPError(bs, http.StatusServiceUnavailable, err)
+		}
+	})
+}
+
+// httpSideHandler authenticates every request of the local client, the requests
+// are forwarded on one stream with the credentials stripped, and the responses
+// are copied back while the next requests are read.
+func (p *ProxyService) httpSideHandler(bs *BufReaderStream, group *PeerGroup) {
+	req, err := http.ReadRequest(bs.Reader)
+	if err != nil {
+		writeHTTPError(bs, 400, err)
+		return
+	}
+	if _, ok := p.httpAuthenticate(bs, req); !ok {
 		return
 	}
 
-	s, err := p.host.NewStream(p.ctx, remotePeer, ID)
+	s, release, err := group.NewStream(p.ctx, ID)
 	if err != nil {
-		Log.Errorf("creating stream to %s error: %v", remotePeer, err)
+		// the disconnection is logged by the group.
+		if err != ErrDisconnected {
+			Log.Errorf("creating stream to the server peers error: %v", err)
+		}
+		writeHTTPError(bs, http.StatusServiceUnavailable, err)
 		return
 	}
 
+	defer release()
 	defer s.Close()
-	if err := tunneling(s, conn); shouldLogError(err) {
+	remotePeer := s.Conn().RemotePeer()
+
+	// done is closed when the server peer closes the stream, the read of the
+	// next request is interrupted then.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := io.Copy(bs, s); shouldLogError(err) {
+			Log.Warn(err)
+		}
+		bs.SetReadDeadline(time.Now())
+	}()
+
+	// reply is the error reply of the last request, it is written after the
+	// responses of the previous requests.
+	var reply func()
+	for req != nil {
+		if err := writeSideRequest(s, req); err != nil {
+			if shouldLogError(err) {
+				Log.Warnf("forwarding request to %s error: %v", remotePeer, err)
+			}
+			break
+		}
+
+		// CONNECT and protocol upgrades take over the connection after the request.
+		if req.Method == http.MethodConnect || isUpgradeRequest(req) {
+			if _, err := io.Copy(s, bs); shouldLogError(err) {
+				Log.Warn(err)
+			}
+			break
+		}
+		req, reply = p.nextSideRequest(bs, done)
+	}
+
+	s.CloseWrite()
+	<-done
+	if reply != nil {
+		reply()
+	}
+}
+
+// nextSideRequest reads and authenticates the next request of the local client,
+// it returns nil at the end of the connection, with the reply of the error if any.
+func (p *ProxyService) nextSideRequest(bs *BufReaderStream, done <-chan struct{}) (*http.Request, func()) {
+	bs.SetReadDeadline(time.Now().Add(httpIdleTimeout))
+	select {
+	case <-done:
+		return nil, nil
+	default:
+	}
+
+	req, err := http.ReadRequest(bs.Reader)
+	if err != nil {
+		select {
+		case <-done:
+			return nil, nil
+		default:
+		}
+		if err == io.EOF || errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil, nil
+		}
+		return nil, func() { writeHTTPError(bs, 400, err) }
+	}
+	bs.SetReadDeadline(time.Time{})
+
+	if _, ok := p.httpVerify(bs, req); !ok {
+		return nil, func() { writeHTTPAuthRequired(bs) }
+	}
+	return req, nil
+}
+
+// writeSideRequest writes the request without the proxy credentials, the body
+// is read from the local client by its framing.
+func writeSideRequest(s Stream, req *http.Request) error {
+	req.Header.Del("Proxy-Authorization")
+	if _, ok := req.Header["User-Agent"]; !ok {
+		// WriteProxy doesn't add its default User-Agent for an empty one.
+		req.Header["User-Agent"] = []string{""}
+	}
+
+	// the header is flushed before the body is read, the client may wait for
+	// "100 Continue" of the origin server.
+	w := bufio.NewWriter(s)
+	req.Body = &flushReader{ReadCloser: req.Body, w: w}
+	if err := req.WriteProxy(w); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// flushReader flushes w before every read.
+type flushReader struct {
+	io.ReadCloser
+	w *bufio.Writer
+}
+
+func (r *flushReader) Read(p []byte) (int, error) {
+	if err := r.w.Flush(); err != nil {
+		return 0, err
+	}
+	return r.ReadCloser.Read(p)
+}
+
+// socks5SideHandler negotiates with the local client, UDP ASSOCIATE is served
+// by the client side, other commands are forwarded to the remote peer.
+func (p *ProxyService) socks5SideHandler(bs *BufReaderStream, group *PeerGroup) {
+	user, err := p.socks5Authenticate(bs)
+	if err != nil {
+		return
+	}
+
+	r, err := socks5.NewRequestFrom(bs.Reader)
+	if err != nil {
+		Log.Error(err)
+		return
+	}
+
+	if r.Cmd == socks5.CmdUDP {
+		err := p.socks5UDPAssociate(bs, r, user, func() (datagramConn, error) {
+			s, release, err := group.NewStream(p.ctx, UDPID)
+			if err != nil {
+				return nil, err
+			}
+			return &releaseDatagramConn{newStreamDatagramConn(s), release}, nil
+		})
+		if shouldLogError(err) {
+			Log.Warn(err)
+		}
+		return
+	}
+
+	p.tunnelSide(bs, group, func(s Stream) error {
+		if err := socks5NegotiateUser(s, user); err != nil {
+			return err
+		}
+		_, err := r.WriteTo(s)
+		return err
+	}, func(error) {
+		replyErr(r, bs, socks5.RepNetworkUnreachable)
+	})
+}
+
+// tunnelSide opens a stream to a server peer, runs the optional handshake
+// and then tunnels the local connection over it. The next server peer is
+// tried if the stream can't be opened, nothing is sent before it. unavailable
+// replies the local client if no server peer is available.
+func (p *ProxyService) tunnelSide(bs *BufReaderStream, group *PeerGroup, handshake func(s Stream) error, unavailable func(err error)) {
+	s, release, err := group.NewStream(p.ctx, ID)
+	if err != nil {
+		// the disconnection is logged by the group.
+		if err != ErrDisconnected {
+			Log.Errorf("creating stream to the server peers error: %v", err)
+		}
+		unavailable(err)
+		return
+	}
+
+	defer release()
+	defer s.Close()
+	remotePeer := s.Conn().RemotePeer()
+	if handshake != nil {
+		if err := handshake(s); err != nil {
+			Log.Errorf("handshake with %s error: %v", remotePeer, err)
+			return
+		}
+	}
+	if err := tunneling(s, bs); shouldLogError(err) {
 		Log.Warn(err)
 	}
 }
+
+// releaseDatagramConn releases the stream of the server peer on Close.
+type releaseDatagramConn struct {
+	datagramConn
+	release func()
+}
+
+func (c *releaseDatagramConn) Close() error {
+	defer c.release()
+	return c.datagramConn.Close()
+}
@@ -0,0 +1,208 @@
+package protocol
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/libp2p/go-libp2p/p2p/protocol/ping"
+
+	"github.com/p2pdao/libp2p-proxy/config"
+)
+
+// newTestListener returns the address of a local proxy listener tunneling to a
+// server peer in memory, the server peer may dial the private addresses, such
+// as the httptest servers.
+func newTestListener(ctx context.Context, t *testing.T, users []config.UserConfig) string {
+	mn, err := mocknet.FullMeshConnected(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { mn.Close() })
+	client, server := mn.Hosts()[0], mn.Hosts()[1]
+
+	egress, err := NewEgressPolicy(config.EgressConfig{AllowPrivate: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	NewProxyService(ctx, server, "p2p.to", WithEgressPolicy(egress))
+	ping.NewPingService(server)
+
+	g, err := NewPeerGroup(client, nil, []peer.AddrInfo{{ID: server.ID()}}, StrategyFailover)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.Check(ctx) != 1 {
+		t.Fatal("the server peer is not healthy")
+	}
+	l, err := NewProxyService(ctx, client, "p2p.to").NewListener("127.0.0.1:0", g, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds, err := NewCredentials(users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.SetCredentials(creds)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go l.handler(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func basicAuth(user, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+}
+
+func TestHTTPSideKeepAlive(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s auth=%q", r.URL.Path, body, r.Header.Get("Proxy-Authorization"))
+	}))
+	defer origin.Close()
+
+	addr := newTestListener(ctx, t, []config.UserConfig{{Username: "alice", Password: "pw"}})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	good, bad := basicAuth("alice", "pw"), basicAuth("alice", "bad")
+	request := func(path, auth, body string) string {
+		return fmt.Sprintf("POST %s%s HTTP/1.1\r\nHost: %s\r\nProxy-Authorization: %s\r\nContent-Length: %d\r\n\r\n%s",
+			origin.URL, path, origin.Listener.Addr(), auth, len(body), body)
+	}
+	readResponse := func(want int, wantBody string) {
+		t.Helper()
+		resp, err := http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != want || !strings.HasPrefix(string(body), wantBody) {
+			t.Fatalf("response = %d %q, want %d %q", resp.StatusCode, body, want, wantBody)
+		}
+	}
+
+	// the pipelined requests are forwarded on the same connection.
+	if _, err := io.WriteString(conn, request("/a", good, "1")+request("/b", good, "22")); err != nil {
+		t.Fatal(err)
+	}
+	readResponse(200, `/a 1 auth=""`)
+	readResponse(200, `/b 22 auth=""`)
+
+	// the body is sent after "100 Continue".
+	fmt.Fprintf(conn, "POST %s/c HTTP/1.1\r\nHost: %s\r\nProxy-Authorization: %s\r\nExpect: 100-continue\r\nContent-Length: 3\r\n\r\n",
+		origin.URL, origin.Listener.Addr(), good)
+	readResponse(100, "")
+	io.WriteString(conn, "333")
+	readResponse(200, `/c 333 auth=""`)
+
+	// a bad credential on the kept alive connection is challenged.
+	io.WriteString(conn, request("/d", bad, ""))
+	readResponse(407, http.StatusText(http.StatusProxyAuthRequired))
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Errorf("the connection is not closed after 407: %v", err)
+	}
+
+	// CONNECT takes over a new connection after the request.
+	conn, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r = bufio.NewReader(conn)
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %[1]s\r\nProxy-Authorization: %s\r\n\r\n", origin.Listener.Addr(), good)
+	// the response of CONNECT has no body.
+	if line, _ := r.ReadString('\n'); !strings.HasPrefix(line, "HTTP/1.1 200 ") {
+		t.Fatalf("CONNECT response = %q", line)
+	}
+	if line, _ := r.ReadString('\n'); line != "\r\n" {
+		t.Fatalf("CONNECT response header = %q", line)
+	}
+	fmt.Fprintf(conn, "GET /e HTTP/1.1\r\nHost: %s\r\n\r\n", origin.Listener.Addr())
+	readResponse(200, `/e  auth=""`)
+}
+
+func TestProxyServiceServe(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.Path)
+	}))
+	defer origin.Close()
+
+	mn, err := mocknet.FullMeshConnected(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mn.Close()
+	client, server := mn.Hosts()[0], mn.Hosts()[1]
+
+	egress, err := NewEgressPolicy(config.EgressConfig{AllowPrivate: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	NewProxyService(ctx, server, "p2p.to", WithEgressPolicy(egress))
+	ping.NewPingService(server)
+	local := NewProxyService(ctx, client, "p2p.to", WithEgressPolicy(egress))
+
+	for _, remote := range []peer.ID{server.ID(), client.ID()} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := ln.Addr().String()
+		ln.Close()
+		go local.Serve(addr, remote)
+
+		hc := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: addr})}}
+		var resp *http.Response
+		// the listener may not serve yet.
+		for i := 0; i < 50; i++ {
+			if resp, err = hc.Get(origin.URL + "/served"); err == nil {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		hc.CloseIdleConnections()
+		if resp.StatusCode != 200 || string(body) != "/served" {
+			t.Errorf("Serve() to %s responds %d %q", remote, resp.StatusCode, body)
+		}
+	}
+}
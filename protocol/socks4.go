@@ -0,0 +1,156 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+)
+
+const (
+	socks4Ver        byte = 0x04
+	socks4CmdConnect byte = 0x01
+	socks4Granted    byte = 0x5a
+	socks4Rejected   byte = 0x5b
+)
+
+var (
+	errSocks4UnsupportCmd = errors.New("unsupported socks4 command")
+	errSocks4BadRequest   = errors.New("bad socks4 request")
+)
+
+func IsSocks4(v byte) bool {
+	return v == socks4Ver
+}
+
+type socks4Request struct {
+	Cmd    byte
+	Port   uint16
+	IP     net.IP
+	UserID string
+	Host   string // SOCKS4a, the hostname to resolve on the server side
+}
+
+func (r *socks4Request) Address() string {
+	host := r.Host
+	if host == "" {
+		host = r.IP.String()
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(r.Port)))
+}
+
+func (p *ProxyService) socks4Handler(bs *BufReaderStream) {
+	if err := p.socks4RequestConnect(bs); shouldLogError(err) {
+		Log.Warn(err)
+	}
+}
+
+func (p *ProxyService) socks4RequestConnect(bs *BufReaderStream) error {
+	r, err := readSocks4Request(bs.Reader)
+	if err != nil {
+		return err
+	}
+
+	if bs.credentials() != nil {
+		// SOCKS4 has no password authentication.
+		Log.Warnf("socks4 rejected for authentication required, user id: %q, remote: %s", r.UserID, bs.RemoteAddr())
+		return writeSocks4Reply(bs, socks4Rejected, nil)
+	}
+
+	if r.Cmd != socks4CmdConnect {
+		if e := writeSocks4Reply(bs, socks4Rejected, nil); e != nil {
+			return e
+		}
+		return errSocks4UnsupportCmd
+	}
+
+	if p.isP2PHttp(r.Address()) {
+		if err := writeSocks4Reply(bs, socks4Granted, nil); err != nil {
+			return err
+		}
+		p.p2phttpHandler(bs, nil)
+		return nil
+	}
+
+	conn, err := p.dial(bs, r.Address())
+	if err != nil {
+		if e := writeSocks4Reply(bs, socks4Rejected, nil); e != nil {
+			return e
+		}
+		return err
+	}
+
+	defer conn.Close()
+	if r.UserID != "" {
+		Log.Debugf("socks4 user id %q connect to %s", r.UserID, r.Address())
+	}
+
+	if err := writeSocks4Reply(bs, socks4Granted, conn.LocalAddr()); err != nil {
+		return err
+	}
+	return tunneling(conn, bs)
+}
+
+// readSocks4Request reads a SOCKS4 or SOCKS4a request:
+// VN(1) CD(1) DSTPORT(2) DSTIP(4) USERID NULL [HOSTNAME NULL]
+func readSocks4Request(r *bufio.Reader) (*socks4Request, error) {
+	b := make([]byte, 8)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	if b[0] != socks4Ver {
+		return nil, errSocks4BadRequest
+	}
+
+	req := &socks4Request{
+		Cmd:  b[1],
+		Port: binary.BigEndian.Uint16(b[2:4]),
+		IP:   net.IP(b[4:8]),
+	}
+
+	var err error
+	if req.UserID, err = readNullString(r); err != nil {
+		return nil, err
+	}
+
+	// SOCKS4a uses 0.0.0.x (x != 0) as DSTIP when the hostname follows.
+	if b[4] == 0 && b[5] == 0 && b[6] == 0 && b[7] != 0 {
+		if req.Host, err = readNullString(r); err != nil {
+			return nil, err
+		}
+		if req.Host == "" {
+			return nil, errSocks4BadRequest
+		}
+	}
+	return req, nil
+}
+
+func readNullString(r *bufio.Reader) (string, error) {
+	b, err := r.ReadSlice(0)
+	if err != nil {
+		if err == bufio.ErrBufferFull {
+			return "", errSocks4BadRequest
+		}
+		return "", err
+	}
+	if len(b) > 256 {
+		return "", errSocks4BadRequest
+	}
+	return string(b[:len(b)-1]), nil
+}
+
+// writeSocks4Reply writes VN(1) CD(1) DSTPORT(2) DSTIP(4), VN is 0.
+func writeSocks4Reply(w io.Writer, code byte, addr net.Addr) error {
+	b := make([]byte, 8)
+	b[1] = code
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		if ip := tcpAddr.IP.To4(); ip != nil {
+			binary.BigEndian.PutUint16(b[2:4], uint16(tcpAddr.Port))
+			copy(b[4:8], ip)
+		}
+	}
+	_, err := w.Write(b)
+	return err
+}
@@ -0,0 +1,72 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestReadSocks4Request(t *testing.T) {
+	header := func(ip ...byte) string {
+		return string(append([]byte{socks4Ver, socks4CmdConnect, 0x01, 0xbb}, ip...))
+	}
+
+	tests := []struct {
+		name    string
+		data    string
+		address string
+		userID  string
+		err     error
+	}{
+		{name: "socks4", data: header(1, 2, 3, 4) + "\x00", address: "1.2.3.4:443"},
+		{name: "user id", data: header(1, 2, 3, 4) + "alice\x00", address: "1.2.3.4:443", userID: "alice"},
+		{name: "socks4a", data: header(0, 0, 0, 1) + "alice\x00example.com\x00", address: "example.com:443", userID: "alice"},
+		{name: "socks4a no user id", data: header(0, 0, 0, 9) + "\x00example.com\x00", address: "example.com:443"},
+		{name: "0.0.0.0 is not socks4a", data: header(0, 0, 0, 0) + "\x00", address: "0.0.0.0:443"},
+		{name: "socks4a empty host", data: header(0, 0, 0, 1) + "\x00\x00", err: errSocks4BadRequest},
+		{name: "bad version", data: "\x05" + header(1, 2, 3, 4)[1:] + "\x00", err: errSocks4BadRequest},
+		{name: "short header", data: header(1, 2), err: io.ErrUnexpectedEOF},
+		{name: "user id without NUL", data: header(1, 2, 3, 4) + "alice", err: io.EOF},
+		{name: "host without NUL", data: header(0, 0, 0, 1) + "\x00example.com", err: io.EOF},
+		{name: "longest user id", data: header(1, 2, 3, 4) + strings.Repeat("u", 255) + "\x00", address: "1.2.3.4:443", userID: strings.Repeat("u", 255)},
+		{name: "overlong user id", data: header(1, 2, 3, 4) + strings.Repeat("u", 256) + "\x00", err: errSocks4BadRequest},
+		{name: "user id over the buffer", data: header(1, 2, 3, 4) + strings.Repeat("u", 5000) + "\x00", err: errSocks4BadRequest},
+		{name: "overlong host", data: header(0, 0, 0, 1) + "\x00" + strings.Repeat("h", 300) + "\x00", err: errSocks4BadRequest},
+	}
+	for _, tt := range tests {
+		r, err := readSocks4Request(bufio.NewReader(strings.NewReader(tt.data)))
+		if err != tt.err {
+			t.Errorf("%s: readSocks4Request() error = %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if r.Address() != tt.address || r.UserID != tt.userID {
+			t.Errorf("%s: readSocks4Request() = %s %q, want %s %q", tt.name, r.Address(), r.UserID, tt.address, tt.userID)
+		}
+	}
+}
+
+func TestWriteSocks4Reply(t *testing.T) {
+	tests := []struct {
+		addr net.Addr
+		want []byte
+	}{
+		{nil, []byte{0, socks4Granted, 0, 0, 0, 0, 0, 0}},
+		{&net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 443}, []byte{0, socks4Granted, 0x01, 0xbb, 1, 2, 3, 4}},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}, []byte{0, socks4Granted, 0, 0, 0, 0, 0, 0}},
+	}
+	for _, tt := range tests {
+		var b bytes.Buffer
+		if err := writeSocks4Reply(&b, socks4Granted, tt.addr); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b.Bytes(), tt.want) {
+			t.Errorf("writeSocks4Reply(%v) = %v, want %v", tt.addr, b.Bytes(), tt.want)
+		}
+	}
+}
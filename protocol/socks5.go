@@ -1,35 +1,71 @@
 package protocol
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"io"
 	"net"
 
 	"github.com/txthinking/socks5"
 )
 
+var errNoAcceptableMethod = errors.New("no acceptable socks5 method")
+
 func IsSocks5(v byte) bool {
 	return v == socks5.Ver
 }
 
 func (p *ProxyService) socks5Handler(bs *BufReaderStream) {
-	if err := socks5Negotiate(bs); shouldLogError(err) {
-		Log.Error(err)
+	user, err := p.socks5Authenticate(bs)
+	if err != nil {
 		return
 	}
 
-	if err := p.socks5RequestConnect(bs); shouldLogError(err) {
+	if err := p.socks5RequestConnect(bs, user); shouldLogError(err) {
 		Log.Warn(err)
 	}
 }
 
-func (p *ProxyService) socks5RequestConnect(bs *BufReaderStream) error {
+// socks5Authenticate negotiates the method with the client, the authenticated
+// username is returned if credentials are required.
+func (p *ProxyService) socks5Authenticate(bs *BufReaderStream) (string, error) {
+	user, err := socks5Negotiate(bs, bs.credentials())
+	switch {
+	case err == socks5.ErrUserPassAuth:
+		Log.Warnf("socks5 authentication failed, user: %q, remote: %s", user, bs.RemoteAddr())
+	case shouldLogError(err):
+		Log.Error(err)
+	}
+	return user, err
+}
+
+func (p *ProxyService) socks5RequestConnect(bs *BufReaderStream, user string) error {
 	r, err := socks5.NewRequestFrom(bs.Reader)
 	if err != nil {
 		return err
 	}
 
-	if r.Cmd != socks5.CmdConnect {
-		if e := replyErr(r, bs, socks5.RepCommandNotSupported); err != nil {
+	switch r.Cmd {
+	case socks5.CmdConnect:
+	case socks5.CmdUDP, socks5.CmdBind:
+		if pl := p.policyOf(bs); !pl.AllowProxy() {
+			Log.Warnf("socks5 command %d is not allowed by policy %s, user: %q, remote: %s", r.Cmd, pl, user, bs.RemoteAddr())
+			if e := replyErr(r, bs, socks5.RepNotAllowed); e != nil {
+				return e
+			}
+			return nil
+		}
+	}
+
+	switch r.Cmd {
+	case socks5.CmdConnect:
+	case socks5.CmdUDP:
+		return p.socks5UDPAssociate(bs, r, user, p.dialUDPRelay)
+	case socks5.CmdBind:
+		return p.socks5Bind(bs, r, user)
+	default:
+		if e := replyErr(r, bs, socks5.RepCommandNotSupported); e != nil {
 			return e
 		}
 		return socks5.ErrUnsupportCmd
@@ -38,7 +74,7 @@ func (p *ProxyService) socks5RequestConnect(bs *BufReaderStream) error {
 	if p.isP2PHttp(r.Address()) {
 		a, addr, port, err := socks5.ParseAddress(r.Address())
 		if err != nil {
-			if e := replyErr(r, bs, socks5.RepHostUnreachable); err != nil {
+			if e := replyErr(r, bs, socks5.RepHostUnreachable); e != nil {
 				return e
 			}
 			return err
@@ -52,18 +88,28 @@ func (p *ProxyService) socks5RequestConnect(bs *BufReaderStream) error {
 		return nil
 	}
 
-	conn, err := net.Dial("tcp", r.Address())
+	conn, err := p.dial(bs, r.Address())
 	if err != nil {
-		if e := replyErr(r, bs, socks5.RepHostUnreachable); err != nil {
+		rep := socks5.RepHostUnreachable
+		if isEgressDenied(err) {
+			rep = socks5.RepNotAllowed
+		}
+		if e := replyErr(r, bs, rep); e != nil {
 			return e
 		}
+		if user != "" {
+			return fmt.Errorf("socks5 user %q connect to %s: %w", user, r.Address(), err)
+		}
 		return err
 	}
 
 	defer conn.Close()
+	if user != "" {
+		Log.Debugf("socks5 user %q connect to %s", user, r.Address())
+	}
 	a, addr, port, err := socks5.ParseAddress(conn.LocalAddr().String())
 	if err != nil {
-		if e := replyErr(r, bs, socks5.RepHostUnreachable); err != nil {
+		if e := replyErr(r, bs, socks5.RepHostUnreachable); e != nil {
 			return e
 		}
 		return err
@@ -77,23 +123,117 @@ func (p *ProxyService) socks5RequestConnect(bs *BufReaderStream) error {
 	return tunneling(conn, bs)
 }
 
-func socks5Negotiate(bs *BufReaderStream) error {
+func socks5Negotiate(bs *BufReaderStream, creds *Credentials) (string, error) {
 	rq, err := socks5.NewNegotiationRequestFrom(bs.Reader)
 	if err != nil {
-		return err
+		return "", err
+	}
+
+	method := socks5.MethodNone
+	switch {
+	case creds != nil:
+		method = socks5.MethodUsernamePassword
+	case bs.listener == nil && bytes.IndexByte(rq.Methods, socks5.MethodUsernamePassword) >= 0:
+		// the client side peer forwards the username of its client, unverified.
+		method = socks5.MethodUsernamePassword
 	}
 
 	for _, m := range rq.Methods {
-		if m == socks5.MethodNone {
-			rp := socks5.NewNegotiationReply(socks5.MethodNone)
-			_, err = rp.WriteTo(bs)
-			return err
+		if m == method {
+			rp := socks5.NewNegotiationReply(method)
+			if _, err = rp.WriteTo(bs); err != nil {
+				return "", err
+			}
+			switch {
+			case creds != nil:
+				return socks5UserPassAuth(bs, creds)
+			case method == socks5.MethodUsernamePassword:
+				return socks5ForwardedUser(bs)
+			}
+			return "", nil
 		}
 	}
 
 	rp := socks5.NewNegotiationReply(socks5.MethodUnsupportAll)
+	if _, err = rp.WriteTo(bs); err != nil {
+		return "", err
+	}
+	return "", errNoAcceptableMethod
+}
+
+// socks5UserPassAuth runs the RFC 1929 username/password sub-negotiation.
+func socks5UserPassAuth(bs *BufReaderStream, creds *Credentials) (string, error) {
+	rq, err := socks5.NewUserPassNegotiationRequestFrom(bs.Reader)
+	if err != nil {
+		return "", err
+	}
+
+	user := string(rq.Uname)
+	if !creds.Verify(user, string(rq.Passwd)) {
+		rp := socks5.NewUserPassNegotiationReply(socks5.UserPassStatusFailure)
+		rp.WriteTo(bs)
+		return user, socks5.ErrUserPassAuth
+	}
+
+	rp := socks5.NewUserPassNegotiationReply(socks5.UserPassStatusSuccess)
 	_, err = rp.WriteTo(bs)
-	return err
+	return user, err
+}
+
+// socks5ForwardedUser reads the username forwarded by the client side peer. The
+// server can't verify it, so it is only a label of the client in the logs, the
+// remote peer is prefixed, such as "12D3KooW.../alice".
+func socks5ForwardedUser(bs *BufReaderStream) (string, error) {
+	rq, err := socks5.NewUserPassNegotiationRequestFrom(bs.Reader)
+	if err != nil {
+		return "", err
+	}
+
+	rp := socks5.NewUserPassNegotiationReply(socks5.UserPassStatusSuccess)
+	_, err = rp.WriteTo(bs)
+	return bs.RemoteAddr() + "/" + string(rq.Uname), err
+}
+
+// forwardedPasswd is the password of a forwarded username, RFC 1929 requires
+// one byte at least, the real password is never sent to the server.
+const forwardedPasswd = "-"
+
+// socks5NegotiateUser negotiates with the remote proxy server for the local client
+// authenticated already, the username is forwarded by the RFC 1929 sub-negotiation
+// if it is not empty. The servers without it select the no-auth method.
+func socks5NegotiateUser(s Stream, user string) error {
+	methods := []byte{socks5.MethodNone}
+	if user != "" {
+		methods = []byte{socks5.MethodUsernamePassword, socks5.MethodNone}
+	}
+	rq := socks5.NewNegotiationRequest(methods)
+	if _, err := rq.WriteTo(s); err != nil {
+		return err
+	}
+
+	rp, err := socks5.NewNegotiationReplyFrom(s)
+	if err != nil {
+		return err
+	}
+	switch {
+	case rp.Method == socks5.MethodNone:
+		return nil
+	case rp.Method != socks5.MethodUsernamePassword || user == "":
+		return errNoAcceptableMethod
+	}
+
+	urq := socks5.NewUserPassNegotiationRequest([]byte(user), []byte(forwardedPasswd))
+	if _, err := urq.WriteTo(s); err != nil {
+		return err
+	}
+	urp, err := socks5.NewUserPassNegotiationReplyFrom(s)
+	if err != nil {
+		return err
+	}
+	if urp.Status != socks5.UserPassStatusSuccess {
+		return socks5.ErrUserPassAuth
+	}
+	return nil
 }
 
 func replyErr(req *socks5.Request, rw io.ReadWriter, rep byte) error {
@@ -0,0 +1,127 @@
+package protocol
+
+import (
+	"net"
+	"testing"
+
+	"github.com/txthinking/socks5"
+
+	"github.com/p2pdao/libp2p-proxy/config"
+)
+
+func TestSocks5Negotiate(t *testing.T) {
+	creds, err := NewCredentials([]config.UserConfig{{Username: "alice", Password: "pw"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		local    bool // a local proxy listener, or a libp2p stream
+		creds    *Credentials
+		methods  []byte
+		password string
+		method   byte   // selected by the server
+		status   byte   // of the username/password sub-negotiation
+		user     string // returned by socks5Negotiate
+		err      error
+	}{
+		{name: "no auth", local: true, methods: []byte{socks5.MethodNone}, method: socks5.MethodNone},
+		{
+			name: "no auth rejects username", local: true, methods: []byte{socks5.MethodUsernamePassword},
+			method: socks5.MethodUnsupportAll, err: errNoAcceptableMethod,
+		},
+		{
+			name: "auth required", local: true, creds: creds, methods: []byte{socks5.MethodNone},
+			method: socks5.MethodUnsupportAll, err: errNoAcceptableMethod,
+		},
+		{
+			name: "auth", local: true, creds: creds, methods: []byte{socks5.MethodNone, socks5.MethodUsernamePassword},
+			password: "pw", method: socks5.MethodUsernamePassword, status: socks5.UserPassStatusSuccess, user: "alice",
+		},
+		{
+			name: "auth bad password", local: true, creds: creds, methods: []byte{socks5.MethodUsernamePassword},
+			password: "bad", method: socks5.MethodUsernamePassword, status: socks5.UserPassStatusFailure, user: "alice", err: socks5.ErrUserPassAuth,
+		},
+		{name: "stream no auth", methods: []byte{socks5.MethodNone}, method: socks5.MethodNone},
+		{
+			// the forwarded username is an unverified label prefixed with the remote.
+			name: "stream forwarded user", methods: []byte{socks5.MethodUsernamePassword, socks5.MethodNone},
+			password: forwardedPasswd, method: socks5.MethodUsernamePassword, status: socks5.UserPassStatusSuccess, user: "pipe/alice",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			bs := NewBufReaderStream(server)
+			if tt.local {
+				bs.listener = &Listener{}
+				bs.listener.SetCredentials(tt.creds)
+			}
+			type result struct {
+				user string
+				err  error
+			}
+			done := make(chan result, 1)
+			go func() {
+				defer server.Close()
+				user, err := socks5Negotiate(bs, tt.creds)
+				done <- result{user, err}
+			}()
+
+			if _, err := socks5.NewNegotiationRequest(tt.methods).WriteTo(client); err != nil {
+				t.Fatal(err)
+			}
+			rp, err := socks5.NewNegotiationReplyFrom(client)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rp.Method != tt.method {
+				t.Fatalf("method = %d, want %d", rp.Method, tt.method)
+			}
+			if rp.Method == socks5.MethodUsernamePassword {
+				rq := socks5.NewUserPassNegotiationRequest([]byte("alice"), []byte(tt.password))
+				if _, err := rq.WriteTo(client); err != nil {
+					t.Fatal(err)
+				}
+				urp, err := socks5.NewUserPassNegotiationReplyFrom(client)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if urp.Status != tt.status {
+					t.Errorf("status = %d, want %d", urp.Status, tt.status)
+				}
+			}
+
+			res := <-done
+			if res.user != tt.user || res.err != tt.err {
+				t.Errorf("socks5Negotiate() = %q, %v, want %q, %v", res.user, res.err, tt.user, tt.err)
+			}
+		})
+	}
+}
+
+func TestSocks5NegotiateUser(t *testing.T) {
+	for _, user := range []string{"", "alice"} {
+		client, server := net.Pipe()
+		done := make(chan string, 1)
+		go func() {
+			defer server.Close()
+			label, _ := socks5Negotiate(NewBufReaderStream(server), nil)
+			done <- label
+		}()
+
+		if err := socks5NegotiateUser(client, user); err != nil {
+			t.Errorf("socks5NegotiateUser(%q) error: %v", user, err)
+		}
+		want := ""
+		if user != "" {
+			want = "pipe/" + user
+		}
+		if got := <-done; got != want {
+			t.Errorf("the server label of %q = %q, want %q", user, got, want)
+		}
+		client.Close()
+	}
+}
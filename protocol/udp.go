@@ -0,0 +1,363 @@
+package protocol
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/txthinking/socks5"
+)
+
+const (
+	udpIdleTimeout  = 60 * time.Second
+	maxDatagramSize = math.MaxUint16
+)
+
+var errDatagramTooLarge = errors.New("socks5 datagram too large")
+
+// datagramConn transfers socks5 UDP datagrams, the destination (or source)
+// address is carried in the datagram header.
+type datagramConn interface {
+	ReadDatagram() (*socks5.Datagram, error)
+	WriteDatagram(d *socks5.Datagram) error
+	Close() error
+}
+
+// UDPHandler relays the datagrams of a socks5 UDP association to their destinations.
+func (p *ProxyService) UDPHandler(s network.Stream) {
+	if err := s.Scope().SetService(ServiceName); err != nil {
+		Log.Errorf("error attaching stream to service: %s", err)
+		s.Reset()
+		return
+	}
+
+	pl := p.policy(s.Conn().RemotePeer())
+	if !pl.AllowProxy() {
+		Log.Warnf("udp relay is not allowed for peer %s by policy %s", s.Conn().RemotePeer(), pl)
+		s.Reset()
+		return
+	}
+
+	s, release := pl.limitStream(s)
+	defer release()
+
+	relay, err := newUDPRelayConn(p.egressOf(pl))
+	if err != nil {
+		Log.Errorf("creating udp relay error: %s", err)
+		s.Reset()
+		return
+	}
+
+	if err := pipeDatagrams(newStreamDatagramConn(s), relay, udpIdleTimeout); shouldLogError(err) {
+		Log.Warn(err)
+	}
+}
+
+// socks5UDPAssociate opens a local UDP relay socket for the client,
+// the datagrams are sent to the exit side by the conn from dial.
+func (p *ProxyService) socks5UDPAssociate(bs *BufReaderStream, r *socks5.Request, user string, dial func() (datagramConn, error)) error {
+	conn, ok := bs.s.(net.Conn)
+	if !ok {
+		// the client side handles UDP ASSOCIATE, it never arrives on a libp2p stream.
+		if e := replyErr(r, bs, socks5.RepCommandNotSupported); e != nil {
+			return e
+		}
+		return socks5.ErrUnsupportCmd
+	}
+
+	laddr, _ := conn.LocalAddr().(*net.TCPAddr)
+	raddr, _ := conn.RemoteAddr().(*net.TCPAddr)
+	if laddr == nil || raddr == nil {
+		if e := replyErr(r, bs, socks5.RepCommandNotSupported); e != nil {
+			return e
+		}
+		return socks5.ErrUnsupportCmd
+	}
+
+	uc, err := net.ListenUDP("udp", &net.UDPAddr{IP: laddr.IP})
+	if err != nil {
+		if e := replyErr(r, bs, socks5.RepServerFailure); e != nil {
+			return e
+		}
+		return err
+	}
+	defer uc.Close()
+
+	remote, err := dial()
+	if err != nil {
+		if e := replyErr(r, bs, socks5.RepNetworkUnreachable); e != nil {
+			return e
+		}
+		return err
+	}
+	defer remote.Close()
+
+	a, addr, port, err := socks5.ParseAddress(uc.LocalAddr().String())
+	if err != nil {
+		if e := replyErr(r, bs, socks5.RepServerFailure); e != nil {
+			return e
+		}
+		return err
+	}
+
+	reply := socks5.NewReply(socks5.RepSuccess, a, addr, port)
+	if _, err := reply.WriteTo(bs); err != nil {
+		return err
+	}
+	if user != "" {
+		Log.Debugf("socks5 user %q udp associate on %s", user, uc.LocalAddr())
+	}
+
+	client := &clientUDPConn{
+		conn: uc,
+		ip:   raddr.IP,
+		port: int(binary.BigEndian.Uint16(r.DstPort)),
+		buf:  make([]byte, maxDatagramSize),
+	}
+
+	// the association terminates when the TCP connection closes.
+	go func() {
+		io.Copy(io.Discard, bs)
+		client.Close()
+		remote.Close()
+	}()
+
+	return pipeDatagrams(client, remote, udpIdleTimeout)
+}
+
+func (p *ProxyService) dialUDPRelay() (datagramConn, error) {
+	relay, err := newUDPRelayConn(p.egress.Load())
+	if err != nil {
+		return nil, err
+	}
+	return relay, nil
+}
+
+// pipeDatagrams relays datagrams between a and b until one of them fails
+// or no datagram is relayed within the timeout.
+func pipeDatagrams(a, b datagramConn, timeout time.Duration) error {
+	idle := time.AfterFunc(timeout, func() {
+		a.Close()
+		b.Close()
+	})
+	defer idle.Stop()
+
+	errCh := make(chan error, 2)
+	relay := func(dst, src datagramConn) {
+		for {
+			d, err := src.ReadDatagram()
+			if err == nil {
+				idle.Reset(timeout)
+				err = dst.WriteDatagram(d)
+			}
+			if err != nil {
+				errCh <- err
+				return
+			}
+		}
+	}
+	go relay(a, b)
+	go relay(b, a)
+
+	err := <-errCh
+	a.Close()
+	b.Close()
+	<-errCh
+	return err
+}
+
+// streamDatagramConn frames datagrams on a stream with a 2 bytes length prefix.
+type streamDatagramConn struct {
+	s Stream
+	r io.Reader
+}
+
+func newStreamDatagramConn(s Stream) *streamDatagramConn {
+	return &streamDatagramConn{s: s, r: NewBufReaderStream(s).Reader}
+}
+
+func (c *streamDatagramConn) ReadDatagram() (*socks5.Datagram, error) {
+	var l [2]byte
+	if _, err := io.ReadFull(c.r, l[:]); err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(c.r, b); err != nil {
+		if err == io.EOF {
+			// the stream ends in the frame.
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return socks5.NewDatagramFromBytes(b)
+}
+
+func (c *streamDatagramConn) WriteDatagram(d *socks5.Datagram) error {
+	b := d.Bytes()
+	if len(b) > maxDatagramSize {
+		return errDatagramTooLarge
+	}
+
+	buf := make([]byte, 2, 2+len(b))
+	binary.BigEndian.PutUint16(buf, uint16(len(b)))
+	_, err := c.s.Write(append(buf, b...))
+	return err
+}
+
+func (c *streamDatagramConn) Close() error {
+	return c.s.Close()
+}
+
+// udpRelayConn sends datagrams to their destinations on the exit side, it only
+// accepts datagrams from the addresses it has sent to.
+type udpRelayConn struct {
+	conn   *net.UDPConn
+	egress *EgressPolicy
+	buf    []byte
+
+	mu   sync.Mutex
+	sent map[netip.AddrPort]struct{}
+}
+
+func newUDPRelayConn(egress *EgressPolicy) (*udpRelayConn, error) {
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	return &udpRelayConn{
+		conn:   conn,
+		egress: egress,
+		buf:    make([]byte, maxDatagramSize),
+		sent:   make(map[netip.AddrPort]struct{}),
+	}, nil
+}
+
+func (c *udpRelayConn) ReadDatagram() (*socks5.Datagram, error) {
+	for {
+		n, addr, err := c.conn.ReadFromUDPAddrPort(c.buf)
+		if err != nil {
+			return nil, err
+		}
+		addr = netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+		if !c.hasSent(addr) {
+			Log.Debugf("udp datagram from %s dropped, no datagram was sent to it", addr)
+			continue
+		}
+
+		a, ip, port, err := socks5.ParseAddress(addr.String())
+		if err != nil {
+			return nil, err
+		}
+		return socks5.NewDatagram(a, ip, port, c.buf[:n]), nil
+	}
+}
+
+func (c *udpRelayConn) hasSent(addr netip.AddrPort) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.sent[addr]
+	return ok
+}
+
+// WriteDatagram drops the datagram that can't be sent, UDP is unreliable anyway.
+func (c *udpRelayConn) WriteDatagram(d *socks5.Datagram) error {
+	address := d.Address()
+	if c.egress != nil {
+		addrs, err := c.egress.Resolve(context.Background(), address)
+		if err != nil {
+			Log.Debugf("udp datagram to %s dropped: %v", address, err)
+			return nil
+		}
+		address = addrs[0]
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		Log.Debugf("resolve udp address error: %v", err)
+		return nil
+	}
+
+	to := addr.AddrPort()
+	to = netip.AddrPortFrom(to.Addr().Unmap(), to.Port())
+	c.mu.Lock()
+	c.sent[to] = struct{}{}
+	c.mu.Unlock()
+
+	if _, err := c.conn.WriteToUDPAddrPort(d.Data, to); err != nil {
+		Log.Debugf("send udp datagram error: %v", err)
+	}
+	return nil
+}
+
+func (c *udpRelayConn) Close() error {
+	return c.conn.Close()
+}
+
+// clientUDPConn is the relay socket of a socks5 UDP association on the client side,
+// it only accepts datagrams from the client host that requested the association.
+type clientUDPConn struct {
+	conn *net.UDPConn
+	ip   net.IP
+	port int // 0 means any port
+	buf  []byte
+
+	mu     sync.Mutex
+	client *net.UDPAddr
+}
+
+func (c *clientUDPConn) ReadDatagram() (*socks5.Datagram, error) {
+	for {
+		n, addr, err := c.conn.ReadFromUDP(c.buf)
+		if err != nil {
+			return nil, err
+		}
+		if !c.accept(addr) {
+			continue
+		}
+
+		d, err := socks5.NewDatagramFromBytes(c.buf[:n])
+		if err != nil || d.Frag != 0 {
+			// fragmentation is not supported, drop it.
+			continue
+		}
+		return d, nil
+	}
+}
+
+func (c *clientUDPConn) WriteDatagram(d *socks5.Datagram) error {
+	c.mu.Lock()
+	client := c.client
+	c.mu.Unlock()
+
+	if client == nil {
+		return nil
+	}
+	_, err := c.conn.WriteToUDP(d.Bytes(), client)
+	return err
+}
+
+func (c *clientUDPConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *clientUDPConn) accept(addr *net.UDPAddr) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.client != nil {
+		return c.client.IP.Equal(addr.IP) && c.client.Port == addr.Port
+	}
+	if !c.ip.Equal(addr.IP) || (c.port != 0 && c.port != addr.Port) {
+		return false
+	}
+	c.client = addr
+	return true
+}
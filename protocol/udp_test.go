@@ -0,0 +1,143 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/txthinking/socks5"
+)
+
+// bufferStream is a Stream of a buffer.
+type bufferStream struct {
+	bytes.Buffer
+}
+
+func (s *bufferStream) Close() error                       { return nil }
+func (s *bufferStream) SetDeadline(t time.Time) error      { return nil }
+func (s *bufferStream) SetReadDeadline(t time.Time) error  { return nil }
+func (s *bufferStream) SetWriteDeadline(t time.Time) error { return nil }
+
+func newDatagram(t *testing.T, address string, data []byte) *socks5.Datagram {
+	a, addr, port, err := socks5.ParseAddress(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a == socks5.ATYPDomain {
+		// NewDatagram adds the length prefix again.
+		addr = addr[1:]
+	}
+	return socks5.NewDatagram(a, addr, port, data)
+}
+
+func TestStreamDatagramConn(t *testing.T) {
+	s := &bufferStream{}
+	c := newStreamDatagramConn(s)
+	want := []*socks5.Datagram{
+		newDatagram(t, "1.2.3.4:53", []byte("query")),
+		newDatagram(t, "[2001:db8::1]:443", []byte{0}),
+		newDatagram(t, "example.com:80", bytes.Repeat([]byte("x"), 1000)),
+	}
+	for _, d := range want {
+		if err := c.WriteDatagram(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, w := range want {
+		d, err := c.ReadDatagram()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.Address() != w.Address() || !bytes.Equal(d.Data, w.Data) {
+			t.Errorf("ReadDatagram() = %s %q, want %s %q", d.Address(), d.Data, w.Address(), w.Data)
+		}
+	}
+	if _, err := c.ReadDatagram(); err != io.EOF {
+		t.Errorf("ReadDatagram() at the end error = %v, want EOF", err)
+	}
+}
+
+func TestStreamDatagramConnTruncated(t *testing.T) {
+	b := newDatagram(t, "1.2.3.4:53", []byte("query")).Bytes()
+	frame := binary.BigEndian.AppendUint16(nil, uint16(len(b)))
+	frame = append(frame, b...)
+
+	for _, n := range []int{1, 2, len(frame) - 1} {
+		s := &bufferStream{}
+		s.Write(frame[:n])
+		if _, err := newStreamDatagramConn(s).ReadDatagram(); err != io.ErrUnexpectedEOF {
+			t.Errorf("ReadDatagram() of %d bytes error = %v, want ErrUnexpectedEOF", n, err)
+		}
+	}
+}
+
+func TestStreamDatagramConnOversize(t *testing.T) {
+	s := &bufferStream{}
+	c := newStreamDatagramConn(s)
+
+	// the largest datagram fits the length prefix.
+	header := len(newDatagram(t, "1.2.3.4:53", nil).Bytes())
+	if err := c.WriteDatagram(newDatagram(t, "1.2.3.4:53", make([]byte, maxDatagramSize-header))); err != nil {
+		t.Fatal(err)
+	}
+	if d, err := c.ReadDatagram(); err != nil || len(d.Data) != maxDatagramSize-header {
+		t.Fatalf("ReadDatagram() of the largest datagram = %v", err)
+	}
+
+	if err := c.WriteDatagram(newDatagram(t, "1.2.3.4:53", make([]byte, maxDatagramSize-header+1))); err != errDatagramTooLarge {
+		t.Errorf("WriteDatagram() of an oversize datagram error = %v, want %v", err, errDatagramTooLarge)
+	}
+	if s.Len() != 0 {
+		t.Errorf("%d bytes of the oversize datagram are written", s.Len())
+	}
+}
+
+func TestUDPRelayConnSources(t *testing.T) {
+	relay, err := newUDPRelayConn(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relay.Close()
+	relayAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: relay.conn.LocalAddr().(*net.UDPAddr).Port}
+
+	dst, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	other, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	if err := relay.WriteDatagram(newDatagram(t, dst.LocalAddr().String(), []byte("query"))); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 16)
+	dst.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := dst.ReadFromUDP(b)
+	if err != nil || string(b[:n]) != "query" {
+		t.Fatalf("the destination read %q, %v", b[:n], err)
+	}
+
+	// a host that no datagram was sent to can't inject one.
+	if _, err := other.WriteToUDP([]byte("injected"), relayAddr); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dst.WriteToUDP([]byte("answer"), relayAddr); err != nil {
+		t.Fatal(err)
+	}
+
+	relay.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	d, err := relay.ReadDatagram()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Address() != dst.LocalAddr().String() || string(d.Data) != "answer" {
+		t.Errorf("ReadDatagram() = %s %q, want %s %q", d.Address(), d.Data, dst.LocalAddr(), "answer")
+	}
+}